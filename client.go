@@ -2,10 +2,11 @@ package toyrpc
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"net"
 	"reflect"
 	"sync"
+	"time"
 
 	. "github.com/2evl1u/toyrpc/log"
 
@@ -15,15 +16,26 @@ import (
 
 var ErrClosed = errors.New("client is closed")
 
+// Call 一次调用，调用结束时会将自身发送到Done中
 type Call struct {
-	*request
-	done    chan struct{}
-	err     error
-	invalid bool // 是否超时（无效）
+	Service string
+	Method  string
+	Args    any
+	Reply   any        // 必须是指针类型，调用成功后返回值写入其中
+	Error   error      // 调用结束后的错误
+	Done    chan *Call // 调用结束时接收该调用
+
+	seq     uint64
+	trailer map[string]string // 服务端随返回发送的trailer
 }
 
-func (c *Call) finished() {
-	c.done <- struct{}{}
+func (c *Call) done() {
+	select {
+	case c.Done <- c:
+	default:
+		// Done的容量不足，丢弃这次通知，由调用方保证容量足够
+		ErrorLogger.Printf("Call %s.%s done channel is full, discard it\n", c.Service, c.Method)
+	}
 }
 
 type client struct {
@@ -32,108 +44,255 @@ type client struct {
 	network    string
 	targetAddr string
 	settings   *Settings
-	sending    *sync.Mutex      // 保证一个返回能完整发送
-	mu         *sync.Mutex      // 保护seq和pending
-	seq        uint64           // 每一个调用的唯一标识
-	pending    map[uint64]*Call // 请求中的调用
-	closed     bool             // 用户关闭了客户端
-	shutdown   bool             // 客户端发生严重错误，被强行关闭
+	sending    *sync.Mutex           // 保证一个返回能完整发送
+	mu         *sync.Mutex           // 保护seq和pending
+	seq        uint64                // 每一个调用的唯一标识
+	pending    map[uint64]*Call      // 请求中的调用
+	streams    map[uint64]*cliStream // 进行中的流式调用
+	closed     bool                  // 用户关闭了客户端
+	shutdown   bool                  // 客户端发生严重错误，被强行关闭
+
+	compressor        string      // 希望使用的压缩方式，为空表示不压缩
+	compressThreshold int         // 不小于该字节数的请求才会被压缩
+	tlsConfig         *tls.Config // 不为nil时连接使用TLS
 }
 
-func newClient(address string, opts ...CliOption) *client {
+func newClient(address string, opts ...CliOption) (*client, error) {
+	// 每个client使用自己的settings副本，选项不会影响其他client
+	settings := DefaultSettings
+	settings.Features = append([]string(nil), DefaultSettings.Features...)
 	cli := &client{
 		network:    DefaultNetwork,
 		targetAddr: address,
-		settings:   &DefaultSettings,
+		settings:   &settings,
 		sending:    new(sync.Mutex),
 		mu:         new(sync.Mutex),
 		seq:        1,
 		pending:    make(map[uint64]*Call),
+		streams:    make(map[uint64]*cliStream),
+
+		compressThreshold: DefaultCompressThreshold,
 	}
 	for _, opt := range opts {
 		opt(cli)
 	}
-	maker, _ := codec.Get(cli.settings.CodecType)
-	conn, err := net.Dial(cli.network, cli.targetAddr)
+	conn, err := cli.dial()
 	if err != nil {
-		panic(err)
+		return nil, errors.WithMessage(err, "dial fail")
 	}
-	cli.netConn = conn
-	cli.Codec = maker(conn)
-	if err := json.NewEncoder(cli.netConn).Encode(cli.settings); err != nil {
-		_ = cli.Codec.Close()
-		panic(err)
+	n, err := cli.handshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithMessage(err, "handshake fail")
+	}
+	c, err := n.newCodec(conn, cli.compressThreshold)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithMessage(err, "create codec fail")
 	}
-	CommonLogger.Printf("Client start, connect to: %s\n", cli.targetAddr)
+	cli.netConn = conn
+	cli.Codec = c
+	CommonLogger.Printf("Client start, connect to: %s, codec: %s, compressor: %s\n", cli.targetAddr, n.codecType, n.compressor)
 	go cli.receive()
-	return cli
+	return cli, nil
 }
 
-func (cli *client) call(ctx context.Context, serviceName, methodName string, args, reply any) error {
-	if reflect.TypeOf(reply).Kind() != reflect.Ptr {
-		return errors.New("the reply should be pointer")
-	}
-	req := &request{
-		h: &codec.Header{
-			Service: serviceName,
-			Method:  methodName,
-			SeqId:   cli.getSeqId(),
-		},
-		args:  reflect.ValueOf(args),
-		reply: reflect.ValueOf(reply),
-	}
-	if err := cli.send(req); err != nil {
-		return errors.WithMessage(err, "send request fail")
+// 连接服务实例，设置了TLS时包装为TLS连接
+func (cli *client) dial() (net.Conn, error) {
+	network, addr := splitNetAddr(cli.targetAddr, cli.network)
+	conn, err := dial(network, addr)
+	if err != nil || cli.tlsConfig == nil {
+		return conn, err
 	}
-	call := &Call{
-		request: req,
-		done:    make(chan struct{}, 1),
-		err:     nil,
+	config := cli.tlsConfig
+	// 没有指定ServerName时使用服务实例的地址来验证证书，unix等没有主机名的地址需要自行指定ServerName
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
 	}
-	if err := cli.registry(call); err != nil {
-		return errors.WithMessage(err, "registry fail")
+	return tls.Client(conn, config), nil
+}
+
+// 发送hello并等待服务端的ack
+func (cli *client) handshake(conn net.Conn) (*negotiated, error) {
+	_ = conn.SetDeadline(time.Now().Add(DefaultHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, errors.WithMessage(err, "tls handshake fail")
+		}
+	}
+	h := &hello{
+		version:  HandshakeVersion,
+		codecs:   cli.settings.codecs(),
+		features: cli.settings.Features,
+	}
+	if cli.compressor != "" {
+		h.features = append(h.features[:len(h.features):len(h.features)], compressFeature(cli.compressor))
+	}
+	if err := writeHello(conn, h); err != nil {
+		return nil, errors.WithMessage(err, "write hello fail")
+	}
+	ack, err := readAck(conn)
+	if err != nil {
+		return nil, err
 	}
+	if err = checkAck(h, ack); err != nil {
+		return nil, err
+	}
+	if _, err = codec.Get(ack.codec); err != nil {
+		return nil, errors.WithMessage(err, "server chooses an unknown codec")
+	}
+	return newNegotiated(ack), nil
+}
+
+// 同步调用，直到收到返回或者ctx结束
+func (cli *client) call(ctx context.Context, serviceName, methodName string, args, reply any) error {
+	call := &Call{
+		Service: serviceName,
+		Method:  methodName,
+		Args:    args,
+		Reply:   reply,
+		Done:    make(chan *Call, 1),
+	}
+	cli.start(ctx, call)
 	select {
-	// 超时
+	// 超时，通知服务端取消该调用，若返回已经发出，仍会被receive读取后丢弃
 	case <-ctx.Done():
-		call.invalid = true
-		return errors.New("call fail: " + ctx.Err().Error())
-	case <-call.done:
-		cli.mu.Lock()
-		delete(cli.pending, call.request.h.SeqId)
+		cli.abandon(ctx, call)
+		<-call.Done
+	case <-call.Done:
+	}
+	receiveTrailer(ctx, call.trailer)
+	return call.Error
+}
+
+// 注册并发送调用，失败时直接结束该调用
+func (cli *client) start(ctx context.Context, call *Call) {
+	if call.Reply == nil || reflect.TypeOf(call.Reply).Kind() != reflect.Ptr {
+		call.Error = errors.New("the reply should be pointer")
+		call.done()
+		return
+	}
+	h := &codec.Header{
+		Service: call.Service,
+		Method:  call.Method,
+		Meta:    OutgoingMetadata(ctx),
+	}
+	setTimeout(ctx, h)
+	// 先注册再发送，避免返回先于注册到达
+	seq, err := cli.registry(call)
+	if err != nil {
+		call.Error = errors.WithMessage(err, "registry fail")
+		call.done()
+		return
+	}
+	h.SeqId = seq
+	if err = cli.send(h, call.Args); err != nil {
+		// 若调用仍在pending中，由这里结束，否则已经被receive或terminate结束
+		if cli.removeCall(seq) != nil {
+			call.Error = errors.WithMessage(err, "send request fail")
+			call.done()
+		}
+	}
+}
+
+// 将剩余的超时时间告知服务端，服务端从收到请求时开始计时，据此放弃已经超时的调用
+// 只发送时长而不是截止时间，避免双方时钟不一致导致超时提前或者推迟
+func setTimeout(ctx context.Context, h *codec.Header) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	// 已经超时的调用也要告知服务端，0表示没有超时时间
+	if h.Timeout = int64(time.Until(deadline)); h.Timeout <= 0 {
+		h.Timeout = 1
+	}
+}
+
+// 单向调用，发送请求后立即返回，不注册到pending中
+func (cli *client) notify(ctx context.Context, serviceName, methodName string, args any) error {
+	h := &codec.Header{
+		Service: serviceName,
+		Method:  methodName,
+		Meta:    OutgoingMetadata(ctx),
+		OneWay:  true,
+	}
+	setTimeout(ctx, h)
+	// 仍然需要分配唯一标识，服务端以此区分连接上正在进行的调用
+	cli.mu.Lock()
+	if cli.closed || cli.shutdown {
 		cli.mu.Unlock()
-		return call.err
+		return ErrClosed
+	}
+	h.SeqId = cli.seq
+	cli.seq++
+	cli.mu.Unlock()
+	if err := cli.send(h, args); err != nil {
+		return errors.WithMessage(err, "send request fail")
+	}
+	return nil
+}
+
+// ctx结束时放弃调用，并通知服务端取消
+func (cli *client) abandon(ctx context.Context, call *Call) {
+	if cli.removeCall(call.seq) == nil {
+		// 调用已经结束
+		return
+	}
+	if err := cli.sendCancel(call.seq); err != nil {
+		ErrorLogger.Printf("Send cancel fail: %s\n", err)
 	}
+	call.Error = errors.WithMessage(ctx.Err(), "call fail")
+	call.done()
 }
 
 // 发送请求
-func (cli *client) send(req *request) error {
+func (cli *client) send(h *codec.Header, args any) error {
 	cli.sending.Lock()
 	defer cli.sending.Unlock()
-	if err := cli.Write(req.h, req.args.Interface()); err != nil {
+	if err := cli.Write(h, args); err != nil {
 		return errors.WithMessage(err, "client write fail")
 	}
 	return nil
 }
 
-// 获取唯一标识（需要加锁保证线程安全）
-func (cli *client) getSeqId() uint64 {
+// 发送取消帧，通知服务端放弃对应的调用
+func (cli *client) sendCancel(seq uint64) error {
+	cli.sending.Lock()
+	defer cli.sending.Unlock()
+	h := &codec.Header{
+		SeqId: seq,
+		Type:  codec.MsgCancel,
+	}
+	if err := cli.Write(h, invalidBody); err != nil {
+		return errors.WithMessage(err, "client write cancel fail")
+	}
+	return nil
+}
+
+// 为调用分配唯一标识并注册到pending中
+func (cli *client) registry(call *Call) (uint64, error) {
 	cli.mu.Lock()
 	defer cli.mu.Unlock()
-	ret := cli.seq
+	if cli.closed || cli.shutdown {
+		return 0, ErrClosed
+	}
+	call.seq = cli.seq
 	cli.seq++
-	return ret
+	cli.pending[call.seq] = call
+	return call.seq, nil
 }
 
-// 将调用注册到pending中
-func (cli *client) registry(call *Call) error {
+// 将调用移出pending，只有成功移出的一方可以结束该调用
+func (cli *client) removeCall(seq uint64) *Call {
 	cli.mu.Lock()
 	defer cli.mu.Unlock()
-	if cli.closed || cli.shutdown {
-		return ErrClosed
-	}
-	cli.pending[call.h.SeqId] = call
-	return nil
+	call := cli.pending[seq]
+	delete(cli.pending, seq)
+	return call
 }
 
 func (cli *client) Close() error {
@@ -150,31 +309,42 @@ func (cli *client) receive() {
 	var err error
 	var h codec.Header
 	for {
+		// 每次重置header，gob不会传输零值字段，复用会残留上一个返回的字段
+		h = codec.Header{}
 		if err = cli.ReadHeader(&h); err != nil {
 			// 读取header出错，证明该连接存在问题，应终止该连接
 			break
 		}
-		call := cli.pending[h.SeqId]
+		// 流式调用的消息交给对应的流处理
+		cli.mu.Lock()
+		st := cli.streams[h.SeqId]
+		cli.mu.Unlock()
+		if st != nil {
+			if err = st.dispatch(&h); err != nil {
+				break
+			}
+			continue
+		}
+		// 收到返回后立即将调用移出pending，避免连接关闭时terminate再次结束该调用
+		call := cli.removeCall(h.SeqId)
+		if call != nil {
+			call.trailer = h.Meta
+		}
 		switch {
+		// 调用已经超时被移出pending，丢弃body
 		case call == nil:
-			// 不可能情况
-			break
+			_ = cli.ReadBody(nil)
 		// 调用出错 返回body应为空
 		case h.Err != "":
-			call.err = errors.New(h.Err)
-			call.finished()
+			call.Error = errorFromHeader(&h)
+			_ = cli.ReadBody(nil)
+			call.done()
 		default:
-			err = cli.ReadBody(call.reply.Interface())
-			if err != nil {
-				call.err = err
-			}
-			call.finished()
-			// 读取完毕发现是超时的无效请求，删除
-			if call.invalid { // 这里先读取再丢弃是为了保证后面的调用返回能正确读取
-				cli.mu.Lock()
-				delete(cli.pending, call.request.h.SeqId)
-				cli.mu.Unlock()
+			// body解码失败只影响这一个调用
+			if e := cli.ReadBody(call.Reply); e != nil {
+				call.Error = errors.WithMessage(e, "read reply fail")
 			}
+			call.done()
 		}
 	}
 	cli.terminate(err)
@@ -188,22 +358,46 @@ func (cli *client) terminate(err error) {
 	defer cli.mu.Unlock()
 	cli.shutdown = true
 	// 将正在pending的调用填写错误原因，全部停止
-	for _, call := range cli.pending {
-		call.err = err
-		call.finished()
+	for seq, call := range cli.pending {
+		delete(cli.pending, seq)
+		call.Error = err
+		call.done()
+	}
+	for seq, st := range cli.streams {
+		delete(cli.streams, seq)
+		st.finish(err, nil)
 	}
 }
 
 type CliOption func(cli *client)
 
+// WithCliNetwork 设置连接服务实例的网络类型，默认tcp
+// 地址为"network@address"的形式时，例如"unix@/tmp/toyrpc.sock"，以地址中的网络类型为准
 func WithCliNetwork(network string) CliOption {
 	return func(cli *client) {
 		cli.network = network
 	}
 }
 
+// WithCliCodecType 设置优先使用的编码类型
 func WithCliCodecType(codecType string) CliOption {
 	return func(cli *client) {
 		cli.settings.CodecType = codecType
 	}
 }
+
+// WithCliCompression 要求启用压缩，服务端不支持时不压缩
+// 客户端只压缩不小于threshold字节的请求，返回是否压缩由服务端的阈值决定
+func WithCliCompression(compressor string, threshold int) CliOption {
+	return func(cli *client) {
+		cli.compressor = compressor
+		cli.compressThreshold = threshold
+	}
+}
+
+// WithCliTLSConfig 使用TLS连接服务实例，服务端要求验证客户端证书时在config中设置Certificates
+func WithCliTLSConfig(config *tls.Config) CliOption {
+	return func(cli *client) {
+		cli.tlsConfig = config
+	}
+}
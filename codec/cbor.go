@@ -0,0 +1,611 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// CBOREncDec 使用CBOR编码单个消息，编码结果满足RFC 8949 4.2.1中的core deterministic encoding：
+// 整数与长度使用最短的形式，浮点数使用不损失精度的最短形式，不使用不定长编码，
+// map的key按照其编码后的字节序排序，因此相同的值总是得到相同的字节
+// 结构体编码为以字段名为key的map，可以通过`cbor:"name,omitempty"`标签修改字段名，`cbor:"-"`忽略字段
+type CBOREncDec struct{}
+
+var _ Serializer = CBOREncDec{}
+
+func (CBOREncDec) Marshal(v any) ([]byte, error) {
+	e := &cborEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (CBOREncDec) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("cbor: unmarshal target must be a non-nil pointer")
+	}
+	d := &cborDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.New("cbor: unexpected trailing data")
+	}
+	return nil
+}
+
+func NewCBOREncDec(conn io.ReadWriteCloser) Codec {
+	return NewFrameCodec(conn, CBOREncDec{})
+}
+
+// CBOR的major type
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+const (
+	cborFalse   = 0xf4
+	cborTrue    = 0xf5
+	cborNull    = 0xf6
+	cborFloat16 = 0xf9
+	cborFloat32 = 0xfa
+	cborFloat64 = 0xfb
+)
+
+type cborEncoder struct {
+	buf []byte
+}
+
+// 写入major type以及参数，参数使用最短的形式
+func (e *cborEncoder) writeHead(major byte, arg uint64) {
+	m := major << 5
+	switch {
+	case arg < 24:
+		e.buf = append(e.buf, m|byte(arg))
+	case arg <= math.MaxUint8:
+		e.buf = append(e.buf, m|24, byte(arg))
+	case arg <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, m|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, m|26), uint32(arg))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, m|27), arg)
+	}
+}
+
+func (e *cborEncoder) encodeInt(v int64) {
+	if v >= 0 {
+		e.writeHead(cborUint, uint64(v))
+	} else {
+		e.writeHead(cborNegInt, uint64(-1-v))
+	}
+}
+
+// 浮点数使用能够精确表示该值的最短形式，NaN统一编码为0xf97e00
+func (e *cborEncoder) encodeFloat(f float64) {
+	if math.IsNaN(f) {
+		e.buf = append(e.buf, cborFloat16, 0x7e, 0x00)
+		return
+	}
+	if f32 := float32(f); float64(f32) == f {
+		if h, ok := float32ToHalf(f32); ok {
+			e.buf = binary.BigEndian.AppendUint16(append(e.buf, cborFloat16), h)
+			return
+		}
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, cborFloat32), math.Float32bits(f32))
+		return
+	}
+	e.buf = binary.BigEndian.AppendUint64(append(e.buf, cborFloat64), math.Float64bits(f))
+}
+
+// 将float32精确转换为半精度浮点数，无法精确表示时返回false
+func float32ToHalf(f float32) (uint16, bool) {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23&0xff) - 127
+	mant := bits & 0x7fffff
+	switch {
+	case bits&0x7fffffff == 0:
+		return sign, true
+	case exp == 128: // Inf，NaN已经在之前处理
+		return sign | 0x7c00, true
+	case exp >= -14 && exp <= 15:
+		if mant&0x1fff != 0 {
+			return 0, false
+		}
+		return sign | uint16(exp+15)<<10 | uint16(mant>>13), true
+	case exp >= -24 && exp < -14:
+		// 半精度的非规格化数，值为h * 2^-24
+		sig := mant | 0x800000
+		shift := uint(-(exp + 1))
+		if sig&(1<<shift-1) != 0 {
+			return 0, false
+		}
+		return sign | uint16(sig>>shift), true
+	}
+	return 0, false
+}
+
+func halfToFloat64(h uint16) float64 {
+	exp := int(h >> 10 & 0x1f)
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+type cborPair struct {
+	key, val []byte
+}
+
+// 分别编码map的每一对key和value，按照key编码后的字节序排序之后写入
+func (e *cborEncoder) writeMap(pairs []cborPair) {
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].key, pairs[j].key) < 0
+	})
+	e.writeHead(cborMap, uint64(len(pairs)))
+	for _, p := range pairs {
+		e.buf = append(append(e.buf, p.key...), p.val...)
+	}
+}
+
+func encodeCBORValue(v reflect.Value) ([]byte, error) {
+	sub := &cborEncoder{}
+	err := sub.encode(v)
+	return sub.buf, err
+}
+
+func (e *cborEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, cborNull)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, cborTrue)
+		} else {
+			e.buf = append(e.buf, cborFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeHead(cborUint, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.encodeFloat(v.Float())
+	case reflect.String:
+		e.writeHead(cborText, uint64(v.Len()))
+		e.buf = append(e.buf, v.String()...)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		// []byte编码为byte string
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.writeHead(cborBytes, uint64(len(b)))
+			e.buf = append(e.buf, b...)
+			return nil
+		}
+		e.writeHead(cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		pairs := make([]cborPair, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			k, err := encodeCBORValue(iter.Key())
+			if err != nil {
+				return err
+			}
+			val, err := encodeCBORValue(iter.Value())
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, cborPair{key: k, val: val})
+		}
+		e.writeMap(pairs)
+	case reflect.Struct:
+		fields := structFields(v.Type(), "cbor")
+		pairs := make([]cborPair, 0, len(fields))
+		for _, f := range fields {
+			fv := v.Field(f.index)
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			k, _ := encodeCBORValue(reflect.ValueOf(f.name))
+			val, err := encodeCBORValue(fv)
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, cborPair{key: k, val: val})
+		}
+		e.writeMap(pairs)
+	default:
+		return fmt.Errorf("cbor: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+type cborDecoder struct {
+	data  []byte
+	pos   int
+	depth int // 当前值的嵌套层数，不超过maxNestingDepth
+}
+
+var (
+	errCBORShort   = errors.New("cbor: unexpected end of data")
+	errCBORTooDeep = errors.New("cbor: exceeded max nesting depth")
+)
+
+// 进入一层嵌套，需要与leave成对调用
+func (d *cborDecoder) enter() error {
+	if d.depth++; d.depth > maxNestingDepth {
+		return errCBORTooDeep
+	}
+	return nil
+}
+
+func (d *cborDecoder) leave() {
+	d.depth--
+}
+
+func (d *cborDecoder) readN(n uint64) ([]byte, error) {
+	if uint64(len(d.data)-d.pos) < n {
+		return nil, errCBORShort
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// cborItem 一个数据项的头部，浮点数的值已经转换为float64
+type cborItem struct {
+	major byte
+	info  byte // additional information，major为7时用于区分简单值与浮点数
+	arg   uint64
+	float float64
+}
+
+func (it cborItem) isFloat() bool {
+	return it.major == cborSimple && it.info >= 25 && it.info <= 27
+}
+
+func (it cborItem) isNull() bool {
+	return it.major == cborSimple && (it.info == 22 || it.info == 23)
+}
+
+func (it cborItem) isBool() bool {
+	return it.major == cborSimple && (it.info == 20 || it.info == 21)
+}
+
+// 读取一个数据项的头部，标签会被跳过，只解码其内容
+func (d *cborDecoder) readHead() (cborItem, error) {
+	for {
+		b, err := d.readN(1)
+		if err != nil {
+			return cborItem{}, err
+		}
+		it := cborItem{major: b[0] >> 5, info: b[0] & 0x1f}
+		switch {
+		case it.info < 24:
+			it.arg = uint64(it.info)
+		case it.info <= 27:
+			ab, err := d.readN(1 << (it.info - 24))
+			if err != nil {
+				return cborItem{}, err
+			}
+			for _, c := range ab {
+				it.arg = it.arg<<8 | uint64(c)
+			}
+		default:
+			// 不支持不定长编码
+			return cborItem{}, fmt.Errorf("cbor: unsupported additional information %d", it.info)
+		}
+		if it.major == cborTag {
+			continue
+		}
+		if it.major == cborSimple {
+			switch it.info {
+			case 25:
+				it.float = halfToFloat64(uint16(it.arg))
+			case 26:
+				it.float = float64(math.Float32frombits(uint32(it.arg)))
+			case 27:
+				it.float = math.Float64frombits(it.arg)
+			}
+		}
+		return it, nil
+	}
+}
+
+var cborMajorNames = [...]string{"uint", "negint", "bytes", "text", "array", "map", "tag", "simple"}
+
+func (d *cborDecoder) decode(v reflect.Value) error {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	it, err := d.readHead()
+	if err != nil {
+		return err
+	}
+	return d.decodeValue(v, it)
+}
+
+func (d *cborDecoder) decodeValue(v reflect.Value, it cborItem) error {
+	if it.isNull() {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	mismatch := func() error {
+		return fmt.Errorf("cbor: cannot decode %s into %s", cborMajorNames[it.major], v.Type())
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeValue(v.Elem(), it)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return mismatch()
+		}
+		x, err := d.decodeAny(it)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(&x).Elem())
+	case reflect.Bool:
+		if !it.isBool() {
+			return mismatch()
+		}
+		v.SetBool(it.info == 21)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if (it.major != cborUint && it.major != cborNegInt) || it.arg > math.MaxInt64 {
+			return mismatch()
+		}
+		n := int64(it.arg)
+		if it.major == cborNegInt {
+			n = -1 - n
+		}
+		if v.OverflowInt(n) {
+			return mismatch()
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if it.major != cborUint || v.OverflowUint(it.arg) {
+			return mismatch()
+		}
+		v.SetUint(it.arg)
+	case reflect.Float32, reflect.Float64:
+		switch {
+		case it.isFloat():
+			v.SetFloat(it.float)
+		case it.major == cborUint:
+			v.SetFloat(float64(it.arg))
+		case it.major == cborNegInt:
+			v.SetFloat(-1 - float64(it.arg))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		if it.major != cborText && it.major != cborBytes {
+			return mismatch()
+		}
+		b, err := d.readN(it.arg)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (it.major == cborBytes || it.major == cborText) {
+			b, err := d.readN(it.arg)
+			if err != nil {
+				return err
+			}
+			if v.Kind() == reflect.Slice {
+				v.Set(reflect.MakeSlice(v.Type(), len(b), len(b)))
+			} else if v.Len() != len(b) {
+				return mismatch()
+			}
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		if it.major != cborArray {
+			return mismatch()
+		}
+		// 长度来自数据本身，每个元素至少占用一个字节
+		if it.arg > uint64(len(d.data)-d.pos) {
+			return errCBORShort
+		}
+		n := int(it.arg)
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+		} else if v.Len() != n {
+			return mismatch()
+		}
+		for i := 0; i < n; i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if it.major != cborMap {
+			return mismatch()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for i := uint64(0); i < it.arg; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			val := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(val); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, val)
+		}
+	case reflect.Struct:
+		if it.major != cborMap {
+			return mismatch()
+		}
+		fields := structFields(v.Type(), "cbor")
+		for i := uint64(0); i < it.arg; i++ {
+			var name string
+			if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			found := false
+			for _, f := range fields {
+				if f.name == name {
+					if err := d.decode(v.Field(f.index)); err != nil {
+						return err
+					}
+					found = true
+					break
+				}
+			}
+			// 跳过不认识的字段
+			if !found {
+				if _, err := d.next(); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+// 解码到interface{}中，非负整数为uint64，负整数为int64，map的key都是字符串时为map[string]any
+func (d *cborDecoder) decodeAny(it cborItem) (any, error) {
+	switch it.major {
+	case cborUint:
+		return it.arg, nil
+	case cborNegInt:
+		if it.arg > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(it.arg), nil
+	case cborBytes:
+		b, err := d.readN(it.arg)
+		return append([]byte(nil), b...), err
+	case cborText:
+		b, err := d.readN(it.arg)
+		return string(b), err
+	case cborArray:
+		if it.arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORShort
+		}
+		arr := make([]any, 0, it.arg)
+		for i := uint64(0); i < it.arg; i++ {
+			x, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, x)
+		}
+		return arr, nil
+	case cborMap:
+		var keys, vals []any
+		allStr := true
+		for i := uint64(0); i < it.arg; i++ {
+			k, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			val, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := k.(string); !ok {
+				allStr = false
+			}
+			keys, vals = append(keys, k), append(vals, val)
+		}
+		if allStr {
+			m := make(map[string]any, len(keys))
+			for i, k := range keys {
+				m[k.(string)] = vals[i]
+			}
+			return m, nil
+		}
+		m := make(map[any]any, len(keys))
+		for i, k := range keys {
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, errors.New("cbor: map key is not comparable")
+			}
+			m[k] = vals[i]
+		}
+		return m, nil
+	}
+	switch {
+	case it.isFloat():
+		return it.float, nil
+	case it.isBool():
+		return it.info == 21, nil
+	case it.isNull():
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", it.arg)
+}
+
+func (d *cborDecoder) next() (any, error) {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	it, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeAny(it)
+}
@@ -4,14 +4,35 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
 )
 
+// MsgType 消息的类型
+type MsgType uint8
+
+const (
+	MsgRequest         MsgType = iota // 调用的请求及其返回
+	MsgCancel                         // 客户端放弃了SeqId对应的调用，服务端应取消该调用且不再返回
+	MsgStreamData                     // 流上的一个消息
+	MsgStreamEnd                      // 流结束，带有调用的错误以及trailer
+	MsgStreamHalfClose                // 客户端在流上发送完毕
+	MsgWindowUpdate                   // 流量控制，接收方允许对方继续发送Window个消息
+)
+
 type Header struct {
 	Service string
 	Method  string
 	SeqId   uint64
 	Err     string
+	Code    uint32            // 错误码，为0表示调用成功
+	Details map[string]string // 错误的结构化详情
+	Timeout int64             // 调用剩余的超时时间（纳秒），为0表示没有超时时间，不依赖双方时钟一致
+	Type    MsgType           // 消息类型，默认为MsgRequest
+	Window  uint32            // 窗口更新消息中归还的发送额度
+	OneWay  bool              // 单向调用，服务端执行之后不发送返回
+	// 元数据，请求中为客户端附带的元数据，返回中为服务端设置的trailer
+	Meta map[string]string
 }
 
 type Codec interface {
@@ -22,8 +43,10 @@ type Codec interface {
 }
 
 const (
-	GobType  = "gob"
-	JSONType = "json"
+	GobType     = "gob"
+	JSONType    = "json"
+	MsgpackType = "msgpack"
+	CBORType    = "cbor"
 )
 
 type Maker func(conn io.ReadWriteCloser) Codec
@@ -35,8 +58,10 @@ type typeMap struct {
 
 var defaultTypeMap = &typeMap{
 	m: map[string]Maker{
-		GobType:  NewGobEncDec,
-		JSONType: NewJSONEncDec,
+		GobType:     NewGobEncDec,
+		JSONType:    NewJSONEncDec,
+		MsgpackType: NewMsgpackEncDec,
+		CBORType:    NewCBOREncDec,
 	},
 	mu: new(sync.RWMutex),
 }
@@ -52,22 +77,58 @@ func (tm *typeMap) get(typeName string) (Maker, error) {
 }
 
 func (tm *typeMap) register(typeName string, maker Maker) error {
+	if len(typeName) == 0 || len(typeName) > 255 {
+		return errors.New(fmt.Sprintf("codec name [%s] should be 1 to 255 bytes", typeName))
+	}
+	if maker == nil {
+		return errors.New(fmt.Sprintf("codec maker of [%s] is nil", typeName))
+	}
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
-	maker, ok := tm.m[typeName]
-	if !ok {
+	if _, ok := tm.m[typeName]; ok {
 		return errors.New(fmt.Sprintf("codec with the name [%s] already exists", typeName))
 	}
 	tm.m[typeName] = maker
 	return nil
 }
 
+func (tm *typeMap) unregister(typeName string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if _, ok := tm.m[typeName]; !ok {
+		return errors.New(fmt.Sprintf("inexistent codec type name: %s", typeName))
+	}
+	delete(tm.m, typeName)
+	return nil
+}
+
+func (tm *typeMap) list() []string {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	names := make([]string, 0, len(tm.m))
+	for name := range tm.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // Get 获取相应名字的编解码器生成器
 func Get(typeName string) (Maker, error) {
 	return defaultTypeMap.get(typeName)
 }
 
-// Register 用于注册一个编解码器生成器到toyrpc中
+// Register 用于注册一个编解码器生成器到toyrpc中，名字已经存在时返回错误
 func Register(typeName string, maker Maker) error {
 	return defaultTypeMap.register(typeName, maker)
 }
+
+// Unregister 移除一个编解码器生成器，已经建立的连接不受影响
+func Unregister(typeName string) error {
+	return defaultTypeMap.unregister(typeName)
+}
+
+// List 按照名字的顺序返回所有已注册的编解码器名字
+func List() []string {
+	return defaultTypeMap.list()
+}
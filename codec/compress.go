@@ -0,0 +1,121 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	GzipCompressor    = "gzip"
+	DeflateCompressor = "deflate"
+)
+
+// Compressor 压缩帧中的body
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Compressible 支持压缩body的Codec，FrameCodec实现了该接口
+type Compressible interface {
+	// SetCompression 设置压缩方式，只有不小于threshold字节的body会被压缩，需要在开始收发之前调用
+	SetCompression(c Compressor, threshold int)
+}
+
+var compressors = map[string]Compressor{
+	GzipCompressor:    gzipCompressor{},
+	DeflateCompressor: deflateCompressor{},
+}
+
+// GetCompressor 获取相应名字的压缩方式
+func GetCompressor(name string) (Compressor, error) {
+	c, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("inexistent compressor name: %s", name)
+	}
+	return c, nil
+}
+
+// Compressors 返回所有支持的压缩方式的名字
+func Compressors() []string {
+	names := make([]string, 0, len(compressors))
+	for name := range compressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var ErrDecompressTooLarge = errors.New("decompressed body too large")
+
+// 读取解压之后的数据，超过MaxFrameSize视为出错，避免压缩炸弹耗尽内存
+func readDecompressed(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxFrameSize {
+		return nil, ErrDecompressTooLarge
+	}
+	return data, nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string {
+	return GzipCompressor
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readDecompressed(r)
+}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) Name() string {
+	return DeflateCompressor
+}
+
+func (deflateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readDecompressed(r)
+}
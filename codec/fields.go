@@ -0,0 +1,50 @@
+package codec
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structField 结构体中参与编码的字段
+type structField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+type fieldCacheKey struct {
+	t   reflect.Type
+	tag string
+}
+
+var fieldCache sync.Map // fieldCacheKey -> []structField
+
+// 解析结构体中导出的字段，字段名与选项来自tagName对应的标签，例如`msgpack:"name,omitempty"`，"-"表示忽略该字段
+func structFields(t reflect.Type, tagName string) []structField {
+	key := fieldCacheKey{t: t, tag: tagName}
+	if fs, ok := fieldCache.Load(key); ok {
+		return fs.([]structField)
+	}
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		f := structField{name: sf.Name, index: i}
+		if tag, ok := sf.Tag.Lookup(tagName); ok {
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name != "" {
+				f.name = name
+			}
+			f.omitEmpty = opts == "omitempty"
+		}
+		fields = append(fields, f)
+	}
+	fieldCache.Store(key, fields)
+	return fields
+}
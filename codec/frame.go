@@ -0,0 +1,165 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	. "github.com/2evl1u/toyrpc/log"
+)
+
+// 每一个消息都封装为一个帧，帧的格式是
+// magic(2) | version(1) | flags(1) | header length(4) | body length(4) | header | body
+// 帧头中的整数均为大端序，header与body由Serializer编码
+const (
+	FrameMagic      uint16 = 0x7472 // "tr"
+	FrameVersion    uint8  = 1
+	frameHeaderSize        = 12
+	// MaxFrameSize 帧中header或body的最大长度，超过该长度视为连接出错
+	MaxFrameSize = 64 << 20
+)
+
+// 帧的flags
+const (
+	FlagCompressed uint8 = 1 << iota // body经过了压缩
+)
+
+var (
+	ErrBadMagic      = errors.New("bad frame magic")
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrUnknownFrame  = errors.New("unknown frame version or flags")
+)
+
+// Serializer 只负责编码单个消息，消息的边界由帧来确定
+type Serializer interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// FrameCodec 将Serializer编码的header与body封装为帧进行收发
+// body的编解码出错只影响当前这个消息，不会破坏连接上后续消息的边界
+type FrameCodec struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	s    Serializer
+	body []byte // ReadHeader读到的帧中的body，由ReadBody解码
+
+	compressed bool       // 当前body是否经过了压缩
+	comp       Compressor // 连接上协商的压缩方式，为nil表示不压缩
+	threshold  int        // 不小于该长度的body才会被压缩
+}
+
+var (
+	_ Codec        = (*FrameCodec)(nil)
+	_ Compressible = (*FrameCodec)(nil)
+)
+
+// NewFrameCodec 使用Serializer在conn上收发帧
+func NewFrameCodec(conn io.ReadWriteCloser, s Serializer) *FrameCodec {
+	return &FrameCodec{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		s:    s,
+	}
+}
+
+func (f *FrameCodec) SetCompression(c Compressor, threshold int) {
+	f.comp = c
+	f.threshold = threshold
+}
+
+// 当前能够处理的flags，带有其他flag的帧无法处理
+func (f *FrameCodec) knownFlags() uint8 {
+	if f.comp != nil {
+		return FlagCompressed
+	}
+	return 0
+}
+
+func (f *FrameCodec) Close() error {
+	return f.conn.Close()
+}
+
+// ReadHeader 读取下一个帧并解码其header
+// 版本或flags无法识别的帧返回ErrUnknownFrame，由调用方关闭连接，避免发送方一直等待被丢弃的消息
+func (f *FrameCodec) ReadHeader(header *Header) error {
+	var fh [frameHeaderSize]byte
+	if _, err := io.ReadFull(f.r, fh[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint16(fh[0:2]) != FrameMagic {
+		return ErrBadMagic
+	}
+	version, flags := fh[2], fh[3]
+	hLen, bLen := binary.BigEndian.Uint32(fh[4:8]), binary.BigEndian.Uint32(fh[8:12])
+	if hLen > MaxFrameSize || bLen > MaxFrameSize {
+		return fmt.Errorf("%w: header %d bytes, body %d bytes", ErrFrameTooLarge, hLen, bLen)
+	}
+	if version != FrameVersion || flags&^f.knownFlags() != 0 {
+		ErrorLogger.Printf("Unknown frame, version: %d, flags: %#x\n", version, flags)
+		return fmt.Errorf("%w: version %d, flags %#x", ErrUnknownFrame, version, flags)
+	}
+	buf := make([]byte, hLen+bLen)
+	if _, err := io.ReadFull(f.r, buf); err != nil {
+		return err
+	}
+	f.body = buf[hLen:]
+	f.compressed = flags&FlagCompressed != 0
+	if err := f.s.Unmarshal(buf[:hLen], header); err != nil {
+		return fmt.Errorf("decode frame header fail: %w", err)
+	}
+	return nil
+}
+
+// ReadBody 解码ReadHeader读到的body，body为nil时直接丢弃
+func (f *FrameCodec) ReadBody(body any) error {
+	data := f.body
+	f.body = nil
+	if body == nil {
+		return nil
+	}
+	if f.compressed {
+		var err error
+		if data, err = f.comp.Decompress(data); err != nil {
+			return fmt.Errorf("decompress frame body fail: %w", err)
+		}
+	}
+	return f.s.Unmarshal(data, body)
+}
+
+// Write 编码并发送一个帧，编码出错时不会发送任何数据，连接仍然可用
+func (f *FrameCodec) Write(h *Header, body any) error {
+	hData, err := f.s.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("encode frame header fail: %w", err)
+	}
+	bData, err := f.s.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("encode frame body fail: %w", err)
+	}
+	if len(hData) > MaxFrameSize || len(bData) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	var flags uint8
+	// 压缩之后更小时才使用压缩的结果
+	if f.comp != nil && len(bData) >= f.threshold {
+		if cData, err := f.comp.Compress(bData); err == nil && len(cData) < len(bData) {
+			bData = cData
+			flags |= FlagCompressed
+		}
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(hData)+len(bData))
+	binary.BigEndian.PutUint16(frame[0:2], FrameMagic)
+	frame[2] = FrameVersion
+	frame[3] = flags
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(hData)))
+	binary.BigEndian.PutUint32(frame[8:12], uint32(len(bData)))
+	frame = append(append(frame, hData...), bData...)
+	if _, err = f.conn.Write(frame); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return nil
+}
@@ -1,58 +1,28 @@
 package codec
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/gob"
 	"io"
-	"log"
 )
 
-type GobEncDec struct {
-	conn io.ReadWriteCloser
-	buf  *bufio.Writer
-	enc  *gob.Encoder
-	dec  *gob.Decoder
-}
-
-var _ Codec = (*GobEncDec)(nil)
+// GobEncDec 使用gob编码单个消息，每个消息都带有完整的类型信息
+type GobEncDec struct{}
 
-func (g *GobEncDec) Close() error {
-	return g.conn.Close()
-}
-
-func (g *GobEncDec) ReadHeader(header *Header) error {
-	return g.dec.Decode(header)
-}
+var _ Serializer = GobEncDec{}
 
-func (g *GobEncDec) ReadBody(body any) error {
-	return g.dec.Decode(body)
+func (GobEncDec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func (g *GobEncDec) Write(h *Header, body any) (err error) {
-	defer func() {
-		_ = g.buf.Flush()
-		if err != nil {
-			_ = g.Close()
-		}
-	}()
-	if err := g.enc.Encode(h); err != nil {
-		log.Println("rpc encode fail, gob error encoding header:", err)
-		return err
-	}
-	if err := g.enc.Encode(body); err != nil {
-		log.Println("rpc encode fail: gob error encoding body:", err)
-		return err
-	}
-	return nil
+func (GobEncDec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
 }
 
 func NewGobEncDec(conn io.ReadWriteCloser) Codec {
-	buf := bufio.NewWriter(conn)
-	g := &GobEncDec{
-		conn: conn,
-		buf:  buf,
-		enc:  gob.NewEncoder(buf),
-		dec:  gob.NewDecoder(conn),
-	}
-	return g
+	return NewFrameCodec(conn, GobEncDec{})
 }
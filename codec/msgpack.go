@@ -0,0 +1,651 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// MsgpackEncDec 使用MessagePack编码单个消息
+// 结构体编码为以字段名为key的map，可以通过`msgpack:"name,omitempty"`标签修改字段名，`msgpack:"-"`忽略字段
+type MsgpackEncDec struct{}
+
+var _ Serializer = MsgpackEncDec{}
+
+func (MsgpackEncDec) Marshal(v any) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (MsgpackEncDec) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("msgpack: unmarshal target must be a non-nil pointer")
+	}
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.New("msgpack: unexpected trailing data")
+	}
+	return nil
+}
+
+func NewMsgpackEncDec(conn io.ReadWriteCloser) Codec {
+	return NewFrameCodec(conn, MsgpackEncDec{})
+}
+
+// msgpack中各类型的首字节
+const (
+	mpNil      = 0xc0
+	mpFalse    = 0xc2
+	mpTrue     = 0xc3
+	mpBin8     = 0xc4
+	mpBin16    = 0xc5
+	mpBin32    = 0xc6
+	mpFloat32  = 0xca
+	mpFloat64  = 0xcb
+	mpUint8    = 0xcc
+	mpUint16   = 0xcd
+	mpUint32   = 0xce
+	mpUint64   = 0xcf
+	mpInt8     = 0xd0
+	mpInt16    = 0xd1
+	mpInt32    = 0xd2
+	mpInt64    = 0xd3
+	mpStr8     = 0xd9
+	mpStr16    = 0xda
+	mpStr32    = 0xdb
+	mpArray16  = 0xdc
+	mpArray32  = 0xdd
+	mpMap16    = 0xde
+	mpMap32    = 0xdf
+	mpFixMap   = 0x80
+	mpFixArray = 0x90
+	mpFixStr   = 0xa0
+)
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) writeByte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *msgpackEncoder) writeUint(marker byte, v uint64, size int) {
+	e.buf = append(e.buf, marker)
+	switch size {
+	case 1:
+		e.buf = append(e.buf, byte(v))
+	case 2:
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v))
+	case 4:
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v))
+	case 8:
+		e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+	}
+}
+
+func (e *msgpackEncoder) encodeInt(v int64) {
+	switch {
+	case v >= 0:
+		e.encodeUint(uint64(v))
+	case v >= -32:
+		e.writeByte(byte(v))
+	case v >= math.MinInt8:
+		e.writeUint(mpInt8, uint64(v), 1)
+	case v >= math.MinInt16:
+		e.writeUint(mpInt16, uint64(v), 2)
+	case v >= math.MinInt32:
+		e.writeUint(mpInt32, uint64(v), 4)
+	default:
+		e.writeUint(mpInt64, uint64(v), 8)
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		e.writeByte(byte(v))
+	case v <= math.MaxUint8:
+		e.writeUint(mpUint8, v, 1)
+	case v <= math.MaxUint16:
+		e.writeUint(mpUint16, v, 2)
+	case v <= math.MaxUint32:
+		e.writeUint(mpUint32, v, 4)
+	default:
+		e.writeUint(mpUint64, v, 8)
+	}
+}
+
+// 写入str、bin、array、map的长度，fix为长度较小时使用的首字节，为0表示没有fix格式
+func (e *msgpackEncoder) writeLen(n int, fix byte, fixMax int, m8, m16, m32 byte) {
+	switch {
+	case fix != 0 && n <= fixMax:
+		e.writeByte(fix | byte(n))
+	case m8 != 0 && n <= math.MaxUint8:
+		e.writeUint(m8, uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.writeUint(m16, uint64(n), 2)
+	default:
+		e.writeUint(m32, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	e.writeLen(len(s), mpFixStr, 31, mpStr8, mpStr16, mpStr32)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.writeByte(mpNil)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.writeByte(mpNil)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.writeByte(mpTrue)
+		} else {
+			e.writeByte(mpFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.writeUint(mpFloat32, uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.writeUint(mpFloat64, math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.writeByte(mpNil)
+			return nil
+		}
+		// []byte编码为bin
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.writeLen(len(b), 0, 0, mpBin8, mpBin16, mpBin32)
+			e.buf = append(e.buf, b...)
+			return nil
+		}
+		e.writeLen(v.Len(), mpFixArray, 15, 0, mpArray16, mpArray32)
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.writeByte(mpNil)
+			return nil
+		}
+		e.writeLen(v.Len(), mpFixMap, 15, 0, mpMap16, mpMap32)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := structFields(v.Type(), "msgpack")
+		n := 0
+		for _, f := range fields {
+			if !f.omitEmpty || !v.Field(f.index).IsZero() {
+				n++
+			}
+		}
+		e.writeLen(n, mpFixMap, 15, 0, mpMap16, mpMap32)
+		for _, f := range fields {
+			fv := v.Field(f.index)
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			e.encodeString(f.name)
+			if err := e.encode(fv); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int // 当前值的嵌套层数
+}
+
+// maxNestingDepth 解码时允许的最大嵌套层数，与encoding/json相同
+// 数组与map的嵌套会递归解码，不加限制时很小的帧就可以耗尽栈空间使整个进程退出
+const maxNestingDepth = 10000
+
+var (
+	errMsgpackShort   = errors.New("msgpack: unexpected end of data")
+	errMsgpackTooDeep = errors.New("msgpack: exceeded max nesting depth")
+)
+
+// 进入一层嵌套，超过maxNestingDepth时返回错误，需要与leave成对调用
+func (d *msgpackDecoder) enter() error {
+	if d.depth++; d.depth > maxNestingDepth {
+		return errMsgpackTooDeep
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) leave() {
+	d.depth--
+}
+
+func (d *msgpackDecoder) readByte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errMsgpackShort
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *msgpackDecoder) readN(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// msgpack中值的大类
+type mpKind int
+
+const (
+	mpKindNil mpKind = iota
+	mpKindBool
+	mpKindInt
+	mpKindUint
+	mpKindFloat
+	mpKindStr
+	mpKindBin
+	mpKindArray
+	mpKindMap
+)
+
+// 读取一个值的首字节以及其后的长度或数值
+// 整数与浮点数的值存放在u中（有符号整数为补码，浮点数为位模式），str、bin、array、map的长度存放在n中
+func (d *msgpackDecoder) readHead() (kind mpKind, u uint64, n int, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	readLen := func(size int) (int, error) {
+		l, err := d.readUint(size)
+		return int(l), err
+	}
+	switch {
+	case b <= 0x7f:
+		return mpKindUint, uint64(b), 0, nil
+	case b >= 0xe0:
+		return mpKindInt, uint64(int64(int8(b))), 0, nil
+	case b&0xf0 == mpFixMap:
+		return mpKindMap, 0, int(b & 0x0f), nil
+	case b&0xf0 == mpFixArray:
+		return mpKindArray, 0, int(b & 0x0f), nil
+	case b&0xe0 == mpFixStr:
+		return mpKindStr, 0, int(b & 0x1f), nil
+	}
+	switch b {
+	case mpNil:
+		return mpKindNil, 0, 0, nil
+	case mpFalse, mpTrue:
+		return mpKindBool, uint64(b - mpFalse), 0, nil
+	case mpUint8, mpUint16, mpUint32, mpUint64:
+		u, err = d.readUint(1 << (b - mpUint8))
+		return mpKindUint, u, 0, err
+	case mpInt8:
+		u, err = d.readUint(1)
+		return mpKindInt, uint64(int64(int8(u))), 0, err
+	case mpInt16:
+		u, err = d.readUint(2)
+		return mpKindInt, uint64(int64(int16(u))), 0, err
+	case mpInt32:
+		u, err = d.readUint(4)
+		return mpKindInt, uint64(int64(int32(u))), 0, err
+	case mpInt64:
+		u, err = d.readUint(8)
+		return mpKindInt, u, 0, err
+	case mpFloat32:
+		u, err = d.readUint(4)
+		return mpKindFloat, math.Float64bits(float64(math.Float32frombits(uint32(u)))), 0, err
+	case mpFloat64:
+		u, err = d.readUint(8)
+		return mpKindFloat, u, 0, err
+	case mpStr8, mpStr16, mpStr32:
+		n, err = readLen(1 << (b - mpStr8))
+		return mpKindStr, 0, n, err
+	case mpBin8, mpBin16, mpBin32:
+		n, err = readLen(1 << (b - mpBin8))
+		return mpKindBin, 0, n, err
+	case mpArray16, mpArray32:
+		n, err = readLen(2 << (b - mpArray16))
+		return mpKindArray, 0, n, err
+	case mpMap16, mpMap32:
+		n, err = readLen(2 << (b - mpMap16))
+		return mpKindMap, 0, n, err
+	}
+	return 0, 0, 0, fmt.Errorf("msgpack: unsupported format byte %#x", b)
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	kind, u, n, err := d.readHead()
+	if err != nil {
+		return err
+	}
+	return d.decodeValue(v, kind, u, n)
+}
+
+func (d *msgpackDecoder) decodeValue(v reflect.Value, kind mpKind, u uint64, n int) error {
+	if kind == mpKindNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	mismatch := func() error {
+		return fmt.Errorf("msgpack: cannot decode %s into %s", kindNames[kind], v.Type())
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeValue(v.Elem(), kind, u, n)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return mismatch()
+		}
+		x, err := d.decodeAny(kind, u, n)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+	case reflect.Bool:
+		if kind != mpKindBool {
+			return mismatch()
+		}
+		v.SetBool(u == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if (kind != mpKindInt && kind != mpKindUint) || (kind == mpKindUint && u > math.MaxInt64) || v.OverflowInt(int64(u)) {
+			return mismatch()
+		}
+		v.SetInt(int64(u))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		// 其他实现可能用有符号整数格式编码非负数
+		if (kind != mpKindUint && kind != mpKindInt) || (kind == mpKindInt && int64(u) < 0) || v.OverflowUint(u) {
+			return mismatch()
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch kind {
+		case mpKindFloat:
+			v.SetFloat(math.Float64frombits(u))
+		case mpKindInt:
+			v.SetFloat(float64(int64(u)))
+		case mpKindUint:
+			v.SetFloat(float64(u))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		if kind != mpKindStr && kind != mpKindBin {
+			return mismatch()
+		}
+		b, err := d.readN(n)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (kind == mpKindBin || kind == mpKindStr) {
+			b, err := d.readN(n)
+			if err != nil {
+				return err
+			}
+			if v.Kind() == reflect.Slice {
+				v.Set(reflect.MakeSlice(v.Type(), n, n))
+			} else if v.Len() != n {
+				return mismatch()
+			}
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		if kind != mpKindArray {
+			return mismatch()
+		}
+		if v.Kind() == reflect.Slice {
+			if n > len(d.data)-d.pos {
+				return errMsgpackShort
+			}
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+		} else if v.Len() != n {
+			return mismatch()
+		}
+		for i := 0; i < n; i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if kind != mpKindMap {
+			return mismatch()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			val := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(val); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, val)
+		}
+	case reflect.Struct:
+		if kind != mpKindMap {
+			return mismatch()
+		}
+		fields := structFields(v.Type(), "msgpack")
+		for i := 0; i < n; i++ {
+			var name string
+			if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			found := false
+			for _, f := range fields {
+				if f.name == name {
+					if err := d.decode(v.Field(f.index)); err != nil {
+						return err
+					}
+					found = true
+					break
+				}
+			}
+			// 跳过不认识的字段
+			if !found {
+				if err := d.skip(); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+var kindNames = map[mpKind]string{
+	mpKindNil:   "nil",
+	mpKindBool:  "bool",
+	mpKindInt:   "int",
+	mpKindUint:  "uint",
+	mpKindFloat: "float",
+	mpKindStr:   "str",
+	mpKindBin:   "bin",
+	mpKindArray: "array",
+	mpKindMap:   "map",
+}
+
+// 解码到interface{}中，整数为int64或者uint64，map的key都是字符串时为map[string]any
+func (d *msgpackDecoder) decodeAny(kind mpKind, u uint64, n int) (any, error) {
+	switch kind {
+	case mpKindNil:
+		return nil, nil
+	case mpKindBool:
+		return u == 1, nil
+	case mpKindInt:
+		return int64(u), nil
+	case mpKindUint:
+		return u, nil
+	case mpKindFloat:
+		return math.Float64frombits(u), nil
+	case mpKindStr:
+		b, err := d.readN(n)
+		return string(b), err
+	case mpKindBin:
+		b, err := d.readN(n)
+		return append([]byte(nil), b...), err
+	case mpKindArray:
+		// 长度来自数据本身，预分配的容量不超过剩余的字节数
+		c := n
+		if rest := len(d.data) - d.pos; c > rest {
+			c = rest
+		}
+		arr := make([]any, 0, c)
+		for i := 0; i < n; i++ {
+			x, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, x)
+		}
+		return arr, nil
+	}
+	keys, vals := make([]any, 0), make([]any, 0)
+	allStr := true
+	for i := 0; i < n; i++ {
+		k, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		val, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.(string); !ok {
+			allStr = false
+		}
+		keys, vals = append(keys, k), append(vals, val)
+	}
+	if allStr {
+		m := make(map[string]any, len(keys))
+		for i, k := range keys {
+			m[k.(string)] = vals[i]
+		}
+		return m, nil
+	}
+	m := make(map[any]any, len(keys))
+	for i, k := range keys {
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, errors.New("msgpack: map key is not comparable")
+		}
+		m[k] = vals[i]
+	}
+	return m, nil
+}
+
+func (d *msgpackDecoder) next() (any, error) {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	kind, u, n, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeAny(kind, u, n)
+}
+
+// 跳过一个值
+func (d *msgpackDecoder) skip() error {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	kind, _, n, err := d.readHead()
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case mpKindStr, mpKindBin:
+		_, err = d.readN(n)
+		return err
+	case mpKindArray:
+	case mpKindMap:
+		n *= 2
+	default:
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		if err = d.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+const ProtobufType = "protobuf"
+
+// protobuf编解码器通过Register注册，与用户自定义的编解码器使用相同的扩展方式
+func init() {
+	if err := Register(ProtobufType, NewProtobufEncDec); err != nil {
+		panic(err)
+	}
+}
+
+// ProtoMarshaler 由protoc生成的类型（例如gogo/protobuf）实现的编码接口
+type ProtoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// ProtoUnmarshaler 由protoc生成的类型实现的解码接口
+type ProtoUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+// ProtobufEncDec 将实现了ProtoMarshaler/ProtoUnmarshaler的参数与返回值编码为protobuf消息
+// Header按照下面的定义手动编码，与protobuf的wire格式兼容
+//
+//	message Header {
+//	  string service = 1;
+//	  string method = 2;
+//	  uint64 seq_id = 3;
+//	  string err = 4;
+//	  uint32 code = 5;
+//	  map<string, string> details = 6;
+//	  int64 timeout = 7;
+//	  uint32 type = 8;
+//	  uint32 window = 9;
+//	  map<string, string> meta = 10;
+//	  bool one_way = 11;
+//	}
+type ProtobufEncDec struct{}
+
+var _ Serializer = ProtobufEncDec{}
+
+func (ProtobufEncDec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *Header:
+		return marshalProtoHeader(m), nil
+	case ProtoMarshaler:
+		return m.Marshal()
+	case nil:
+		return nil, nil
+	}
+	// 调用出错时作为占位的空结构体编码为空消息
+	if t := reflect.TypeOf(v); t.Kind() == reflect.Struct && t.NumField() == 0 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("protobuf: type %T does not implement Marshal() ([]byte, error)", v)
+}
+
+func (ProtobufEncDec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *Header:
+		return unmarshalProtoHeader(data, m)
+	case ProtoUnmarshaler:
+		return m.Unmarshal(data)
+	}
+	return fmt.Errorf("protobuf: type %T does not implement Unmarshal([]byte) error", v)
+}
+
+func NewProtobufEncDec(conn io.ReadWriteCloser) Codec {
+	return NewFrameCodec(conn, ProtobufEncDec{})
+}
+
+// protobuf的wire类型
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendTag(b []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendStringField(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendBytesField(b, field, []byte(s))
+}
+
+// map<string, string>编码为重复的entry消息，key为字段1，value为字段2
+func appendMapField(b []byte, field int, m map[string]string) []byte {
+	for k, v := range m {
+		entry := appendStringField(appendStringField(nil, 1, k), 2, v)
+		b = appendBytesField(b, field, entry)
+	}
+	return b
+}
+
+func marshalProtoHeader(h *Header) []byte {
+	var b []byte
+	b = appendStringField(b, 1, h.Service)
+	b = appendStringField(b, 2, h.Method)
+	b = appendVarintField(b, 3, h.SeqId)
+	b = appendStringField(b, 4, h.Err)
+	b = appendVarintField(b, 5, uint64(h.Code))
+	b = appendMapField(b, 6, h.Details)
+	b = appendVarintField(b, 7, uint64(h.Timeout))
+	b = appendVarintField(b, 8, uint64(h.Type))
+	b = appendVarintField(b, 9, uint64(h.Window))
+	b = appendMapField(b, 10, h.Meta)
+	if h.OneWay {
+		b = appendVarintField(b, 11, 1)
+	}
+	return b
+}
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// protoField 解码出的一个字段，varint类型的值在v中，bytes类型的值在data中
+type protoField struct {
+	num  int
+	wire int
+	v    uint64
+	data []byte
+}
+
+// 依次读取消息中的字段，未知的字段由调用方忽略
+func rangeProtoFields(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3), wire: int(tag & 7)}
+		switch f.wire {
+		case wireVarint:
+			if f.v, n = binary.Uvarint(b); n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if f.wire == wireFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return errProtoTruncated
+			}
+			f.data, b = b[:size], b[size:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errProtoTruncated
+			}
+			f.data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", f.wire)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalProtoEntry(data []byte, m *map[string]string) error {
+	var k, v string
+	err := rangeProtoFields(data, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.wire == wireBytes:
+			k = string(f.data)
+		case f.num == 2 && f.wire == wireBytes:
+			v = string(f.data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if *m == nil {
+		*m = make(map[string]string)
+	}
+	(*m)[k] = v
+	return nil
+}
+
+func unmarshalProtoHeader(data []byte, h *Header) error {
+	*h = Header{}
+	return rangeProtoFields(data, func(f protoField) error {
+		if f.wire == wireBytes {
+			switch f.num {
+			case 1:
+				h.Service = string(f.data)
+			case 2:
+				h.Method = string(f.data)
+			case 4:
+				h.Err = string(f.data)
+			case 6:
+				return unmarshalProtoEntry(f.data, &h.Details)
+			case 10:
+				return unmarshalProtoEntry(f.data, &h.Meta)
+			}
+			return nil
+		}
+		if f.wire != wireVarint {
+			return nil
+		}
+		switch f.num {
+		case 3:
+			h.SeqId = f.v
+		case 5:
+			h.Code = uint32(f.v)
+		case 7:
+			h.Timeout = int64(f.v)
+		case 8:
+			h.Type = MsgType(f.v)
+		case 9:
+			h.Window = uint32(f.v)
+		case 11:
+			h.OneWay = f.v != 0
+		}
+		return nil
+	})
+}
@@ -19,13 +19,30 @@ const DefaultCodec = "json"
 const DefaultServerHeartbeatInterval = DefaultTimeoutInterval - time.Minute
 
 var DefaultSettings = Settings{
-	MagicNumber: MagicNumber,
-	CodecType:   codec.JSONType,
+	CodecType: codec.JSONType,
 }
 
+// DefaultCompressThreshold 启用压缩时，不小于该字节数的body才会被压缩
+const DefaultCompressThreshold = 1024
+
+// DefaultHandshakeTimeout 连接建立之后完成握手的最长时间
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Settings 客户端在握手时告知服务端的设置
 type Settings struct {
-	MagicNumber int
-	CodecType   string
+	CodecType string   // 优先使用的编码类型，服务端不支持时会退回内置的编码类型
+	Features  []string // 希望启用的特性，服务端只会启用其支持的部分
+}
+
+// 握手时按照优先级提供的编码类型
+func (s *Settings) codecs() []string {
+	codecs := []string{s.CodecType}
+	for _, name := range []string{codec.JSONType, codec.GobType} {
+		if name != s.CodecType {
+			codecs = append(codecs, name)
+		}
+	}
+	return codecs
 }
 
 func init() {
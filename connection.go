@@ -1,10 +1,15 @@
 package toyrpc
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/2evl1u/toyrpc/log"
 
@@ -14,24 +19,46 @@ import (
 )
 
 // Connection 一个连接上，字节流的格式是
-// Settings | Call1 header | Call1 body | Call2 header | Call2 body | ...
+// Handshake | Call1 frame | Call2 frame | ...
+// 每个帧带有header与body的长度，body解码失败只影响对应的调用
 type connection struct {
 	codec.Codec             // 一个net.Conn对应一个Codec
 	sending     *sync.Mutex // 多个调用的reply在一个套接字上发送，为了保证每一个reply都连续完整，发送时候需要加锁
 	wg          *sync.WaitGroup
+	mu          *sync.Mutex         // 保护draining以及wg的Add，避免与drain中的Wait竞争
+	draining    bool                // 服务器正在关闭，不再接受新的调用
+	calls       map[uint64]*request // 正在进行的调用，用于响应客户端的取消
 	svr         *Server
+	ctx         context.Context // 连接关闭时被取消，是该连接上所有调用context的父context
+	cancel      context.CancelFunc
 }
 
 type request struct {
-	h     *codec.Header
-	args  reflect.Value
-	reply reflect.Value
+	h       *codec.Header
+	args    reflect.Value
+	reply   reflect.Value
+	ctx     context.Context // 调用的context，header中带有截止时间时会被设置
+	cancel  context.CancelFunc
+	trailer *trailer   // 服务方法设置的trailer，随返回发送
+	stream  *svrStream // 流式调用的流，普通调用为nil
+
+	streamParam reflect.Value // 传给流式方法的流参数，例如ServerStream
+
+	abandoned atomic.Bool            // 客户端已经取消了该调用，不再发送返回
+	aborted   atomic.Pointer[Status] // 服务端因流上的错误放弃了该调用，作为调用的错误返回
+}
+
+// 因为流上的错误放弃调用，客户端收到的是reason而不是context被取消的错误
+func (req *request) abort(reason *Status) {
+	req.aborted.CompareAndSwap(nil, reason)
+	req.cancel()
 }
 
 // Handle 接手一个套接字连接
 func (conn *connection) handle() {
 	defer func() {
 		_ = conn.Close()
+		conn.svr.untrackConn(conn)
 	}()
 	for {
 		req := &request{h: new(codec.Header)}
@@ -40,76 +67,280 @@ func (conn *connection) handle() {
 			if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) &&
 				!strings.Contains(err.Error(), "An existing connection was forcibly closed by the remote host") {
 				ErrorLogger.Printf("Connection.Codec read header fail: %s\n", err)
-				req.h.Err = err.Error()
+				setHeaderError(req.h, err)
 				conn.sendResponse(req)
 			}
 			ErrorLogger.Printf("Connection is closed: %s\n", err)
 			break // 解析失败将关闭当前连接
 		}
+		// 超时时间从收到请求时开始计算
+		received := time.Now()
+		// 流上的消息交给对应的流处理
+		if isStreamMsg(req.h.Type) {
+			if err := conn.dispatchStream(req.h); err != nil {
+				ErrorLogger.Printf("Connection.Codec read body fail: %s\n", err)
+				break
+			}
+			continue
+		}
+		// 客户端取消了某个调用，取消其context，之后不再发送返回
+		if req.h.Type == codec.MsgCancel {
+			if err := conn.ReadBody(nil); err != nil {
+				ErrorLogger.Printf("Connection.Codec read body fail: %s\n", err)
+				break
+			}
+			conn.abandon(req.h.SeqId)
+			continue
+		}
 		// 2 解析请求参数（body）
 		// 加载对应服务与方法
+		// 服务或方法不存在时，跳过body并返回错误，连接仍然可用
 		s, ok := conn.svr.serviceMap.Load(req.h.Service)
 		if !ok {
 			ErrorLogger.Printf("Service %s doesn't exist\n", req.h.Service)
-			break
+			if err := conn.reject(req, fmt.Errorf("%w: %s", ErrServiceNotFound, req.h.Service)); err != nil {
+				ErrorLogger.Printf("Connection.Codec read body fail: %s\n", err)
+				break
+			}
+			continue
 		}
 		svc := s.(*service)
 		method, ok := svc.mm[req.h.Method]
 		if !ok {
 			ErrorLogger.Printf("Method %s doesn't exist\n", req.h.Method)
-			break
-		}
-		argT, replyT := method.Type.In(1), method.Type.In(2)
-		req.args, req.reply = newArgv(argT), newReplyv(replyT)
-		// 这里是因为如果arg不是指针类型，需要拿到其指针才能用于下面ReadBody的读取
-		argPtr := req.args.Interface()
-		if req.args.Type().Kind() != reflect.Ptr {
-			argPtr = req.args.Addr().Interface()
-		}
-		if err := conn.ReadBody(argPtr); err != nil {
-			ErrorLogger.Printf("Connection.Codec read body fail: %s\n", err)
-			req.h.Err = err.Error()
-			conn.sendResponse(req)
-			break // 解析失败将关闭当前连接
+			if err := conn.reject(req, fmt.Errorf("%w: %s.%s", ErrMethodNotFound, req.h.Service, req.h.Method)); err != nil {
+				ErrorLogger.Printf("Connection.Codec read body fail: %s\n", err)
+				break
+			}
+			continue
+		}
+		// 流式调用需要双向通信，不能以单向调用的方式发起
+		if req.h.OneWay && method.kind != unaryCall {
+			ErrorLogger.Printf("Method %s.%s is a stream method, ignore one-way call\n", req.h.Service, req.h.Method)
+			if err := conn.ReadBody(nil); err != nil {
+				ErrorLogger.Printf("Connection.Codec read body fail: %s\n", err)
+				break
+			}
+			continue
+		}
+		// 客户端流式以及双向流式调用的请求不带参数，参数在之后的流消息中
+		if method.kind == clientStreaming || method.kind == bidiStreaming {
+			if err := conn.ReadBody(nil); err != nil {
+				ErrorLogger.Printf("Connection.Codec read body fail: %s\n", err)
+				break
+			}
+		} else {
+			req.args = newArgv(method.argType)
+			// 这里是因为如果arg不是指针类型，需要拿到其指针才能用于下面ReadBody的读取
+			argPtr := req.args.Interface()
+			if req.args.Type().Kind() != reflect.Ptr {
+				argPtr = req.args.Addr().Interface()
+			}
+			// 帧确定了body的边界，解析失败只返回错误，连接上的其他调用不受影响
+			if err := conn.ReadBody(argPtr); err != nil {
+				ErrorLogger.Printf("Connection.Codec read body fail: %s\n", err)
+				setHeaderError(req.h, NewStatus(CodeInvalidArgument, err.Error()))
+				conn.sendResponse(req)
+				continue
+			}
+		}
+		if method.kind == unaryCall || method.kind == clientStreaming {
+			req.reply = newReplyv(method.replyType)
 		}
 		// 3 交给一个goroutine完成调用
+		if req.h.Timeout != 0 {
+			req.ctx, req.cancel = context.WithDeadline(conn.ctx, received.Add(time.Duration(req.h.Timeout)))
+		} else {
+			req.ctx, req.cancel = context.WithCancel(conn.ctx)
+		}
+		req.ctx, req.trailer = newIncomingContext(req.ctx, req.h.Meta)
+		// 流式调用需要构造传给方法的流
+		if method.kind != unaryCall {
+			req.stream = newSvrStream(conn, req, method)
+			req.streamParam = newStreamParam(method.streamParamType(), req.stream)
+		}
+		conn.mu.Lock()
+		if conn.draining {
+			conn.mu.Unlock()
+			req.cancel()
+			setHeaderError(req.h, ErrServerClosed)
+			conn.sendResponse(req)
+			continue
+		}
 		conn.wg.Add(1)
+		conn.calls[req.h.SeqId] = req
+		conn.mu.Unlock()
 		go func() {
 			defer conn.wg.Done()
+			defer func() {
+				conn.mu.Lock()
+				delete(conn.calls, req.h.SeqId)
+				conn.mu.Unlock()
+				req.cancel()
+			}()
 			if err := conn.doCall(req); err != nil {
 				ErrorLogger.Printf("Call %s.%s fail: %s\n", req.h.Service, req.h.Method, err)
-				req.h.Err = err.Error()
+				setHeaderError(req.h, err)
 				conn.sendResponse(req)
 			}
 		}()
 	}
 	// 保证如果出错要关闭连接 也应该等待已经发出调用的goroutine返回
+	// 连接已经不可用，通知仍在进行的调用放弃
+	conn.cancel()
+	conn.wg.Wait()
+}
+
+// 丢弃请求的body，并返回错误
+func (conn *connection) reject(req *request, reason error) error {
+	if err := conn.ReadBody(nil); err != nil {
+		return err
+	}
+	setHeaderError(req.h, reason)
+	conn.sendResponse(req)
+	return nil
+}
+
+// 拒绝新的调用，并等待已经发出的调用全部返回
+func (conn *connection) drain() {
+	conn.mu.Lock()
+	conn.draining = true
+	conn.mu.Unlock()
 	conn.wg.Wait()
 }
 
+// 取消客户端放弃的调用
+func (conn *connection) abandon(seq uint64) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if req, ok := conn.calls[seq]; ok {
+		req.abandoned.Store(true)
+		req.cancel()
+		CommonLogger.Printf("Call %s.%s is cancelled by client\n", req.h.Service, req.h.Method)
+	}
+}
+
+// invalidBody 调用出错时作为占位的body发送
+var invalidBody = struct{}{}
+
 func (conn *connection) sendResponse(req *request) {
+	// 客户端已经放弃等待，或者是单向调用，无需返回
+	if req.abandoned.Load() || req.h.OneWay {
+		return
+	}
 	conn.sending.Lock()
 	defer conn.sending.Unlock()
-	var body any
-	// 判断reply是否有效 如果发生了错误 reply应该是个无效的零值
-	if req.reply.IsValid() {
+	// 流式调用以结束消息作为返回，之后流上不能再发送消息
+	if req.stream != nil {
+		req.h.Type = codec.MsgStreamEnd
+		req.stream.closed = true
+	}
+	// 返回中的元数据为trailer，不再携带请求的元数据
+	req.h.Meta = nil
+	if req.trailer != nil {
+		req.h.Meta = req.trailer.get()
+	}
+	var body any = invalidBody
+	// 判断reply是否有效 如果发生了错误 不发送reply
+	if req.reply.IsValid() && req.h.Err == "" {
 		// 如果有效才调用Interface() 否则会panic
 		body = req.reply.Interface()
 	}
 	if err := conn.Write(req.h, body); err != nil {
 		ErrorLogger.Printf("Connection.Codec write fail: %s\n", err)
+		// reply编码失败时没有发送任何数据，改为返回错误，避免客户端一直等待
+		if body != invalidBody {
+			setHeaderError(req.h, NewStatus(CodeInternal, err.Error()))
+			if err = conn.Write(req.h, invalidBody); err != nil {
+				ErrorLogger.Printf("Connection.Codec write fail: %s\n", err)
+			}
+		}
 	}
 }
 
-// 加载对应的服务并调用
+// 加载对应的服务并调用，调用超过了客户端给出的截止时间则直接返回超时错误
 func (conn *connection) doCall(req *request) error {
+	// 请求到达时已经超过截止时间，或者已经因为流上的错误被放弃，不再调用
+	if reason := req.aborted.Load(); reason != nil {
+		return reason
+	}
+	if err := req.ctx.Err(); err != nil {
+		return errors.WithMessage(err, "call expired before handling")
+	}
 	CommonLogger.Printf("Do method %s\n", req.h.Method)
 	s, _ := conn.svr.serviceMap.Load(req.h.Service)
 	svc := s.(*service)
 	method := svc.mm[req.h.Method]
-	ret := method.Func.Call([]reflect.Value{svc.self, req.args, req.reply})
-	if err := ret[0].Interface(); err != nil {
-		return err.(error)
+	invoke := func(ctx context.Context, args, reply any) error {
+		in := []reflect.Value{svc.self}
+		if method.withCtx {
+			in = append(in, reflect.ValueOf(ctx))
+		}
+		in = append(in, reflect.ValueOf(args))
+		// 双向流式方法只有流一个参数
+		if method.kind != bidiStreaming {
+			in = append(in, reflect.ValueOf(reply))
+		}
+		ret := method.Func.Call(in)
+		if err := ret[0].Interface(); err != nil {
+			return err.(error)
+		}
+		return nil
+	}
+	// 使用拦截器包裹方法调用
+	info := &MethodInfo{
+		Service:        req.h.Service,
+		Method:         req.h.Method,
+		IsServerStream: method.kind == serverStreaming || method.kind == bidiStreaming,
+		IsClientStream: method.kind == clientStreaming || method.kind == bidiStreaming,
+	}
+	// 流式方法中，流参数作为拦截器看到的args或reply：
+	// 服务端流式为(args, 流)，客户端流式为(流, reply)，双向流式为(流, nil)
+	var args, reply any
+	switch method.kind {
+	case unaryCall:
+		args, reply = req.args.Interface(), req.reply.Interface()
+	case serverStreaming:
+		args, reply = req.args.Interface(), req.streamParam.Interface()
+	case clientStreaming:
+		args, reply = req.streamParam.Interface(), req.reply.Interface()
+	case bidiStreaming:
+		args = req.streamParam.Interface()
+	}
+	handler := chainSvrInterceptors(conn.svr.interceptors, info, invoke)
+	called := make(chan error, 1)
+	go func() {
+		// 根据配置恢复服务方法的panic，转换为错误返回给客户端，不影响连接上的其他调用
+		if conn.svr.recoverPanic {
+			defer func() {
+				if r := recover(); r != nil {
+					ErrorLogger.Printf("Call %s.%s panic: %v\n%s", req.h.Service, req.h.Method, r, debug.Stack())
+					called <- Errorf(CodePanic, "%s: %v", ErrPanic.Message, r)
+				}
+			}()
+		}
+		called <- handler(req.ctx, args, reply)
+	}()
+	select {
+	// 超时之后方法仍可能在执行，reply不能再被发送
+	// 先返回超时错误，再等待方法返回，保证连接排空时不会遗漏仍在执行的方法
+	case <-req.ctx.Done():
+		err := NewStatus(Code(req.ctx.Err()), "call timeout: "+req.ctx.Err().Error())
+		if reason := req.aborted.Load(); reason != nil {
+			err = reason
+		}
+		ErrorLogger.Printf("Call %s.%s fail: %s\n", req.h.Service, req.h.Method, err)
+		setHeaderError(req.h, err)
+		conn.sendResponse(req)
+		<-called
+		return nil
+	case err := <-called:
+		if reason := req.aborted.Load(); reason != nil {
+			return reason
+		}
+		if err != nil {
+			return err
+		}
 	}
 	conn.sendResponse(req)
 	return nil
@@ -0,0 +1,309 @@
+package toyrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/2evl1u/toyrpc/codec"
+	"github.com/pkg/errors"
+)
+
+// 连接建立之后，客户端先发送hello，服务端回复ack，之后双方才开始收发帧
+//
+// hello: magic(4) | version(1) | codec count(1) | codecs | feature count(1) | features
+// ack:   magic(4) | version(1) | status(1) | 接受时为 codec | feature count(1) | features，拒绝时为 reason
+//
+// 其中codec与feature均为 length(1) | name，reason为 length(2) | text，整数均为大端序
+const HandshakeVersion uint8 = 1
+
+const (
+	ackAccepted uint8 = iota
+	ackRejected
+)
+
+var ErrHandshakeRejected = errors.New("handshake rejected by server")
+
+// 压缩方式作为特性协商，特性名为该前缀加上压缩方式的名字，例如"compress/gzip"
+const compressFeaturePrefix = "compress/"
+
+func compressFeature(name string) string {
+	return compressFeaturePrefix + name
+}
+
+// hello 客户端支持的协议版本、编码类型以及特性，编码类型按照优先级排列
+type hello struct {
+	version  uint8
+	codecs   []string
+	features []string
+}
+
+// helloAck 服务端选定的编码类型与特性，或者拒绝的原因
+type helloAck struct {
+	version  uint8
+	accepted bool
+	codec    string
+	features []string
+	reason   string
+}
+
+// 协商之后连接上使用的编码类型与特性
+type negotiated struct {
+	codecType  string
+	features   map[string]bool
+	compressor string // 使用的压缩方式，为空表示不压缩
+}
+
+func newNegotiated(ack *helloAck) *negotiated {
+	n := &negotiated{codecType: ack.codec, features: make(map[string]bool)}
+	for _, f := range ack.features {
+		n.features[f] = true
+		if name, ok := strings.CutPrefix(f, compressFeaturePrefix); ok {
+			n.compressor = name
+		}
+	}
+	return n
+}
+
+// 按照协商的结果新建Codec，启用了压缩时只压缩不小于threshold字节的body
+func (n *negotiated) newCodec(conn io.ReadWriteCloser, threshold int) (codec.Codec, error) {
+	maker, err := codec.Get(n.codecType)
+	if err != nil {
+		return nil, err
+	}
+	c := maker(conn)
+	if n.compressor == "" {
+		return c, nil
+	}
+	comp, err := codec.GetCompressor(n.compressor)
+	if err != nil {
+		return nil, err
+	}
+	cc, ok := c.(codec.Compressible)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("codec %s doesn't support compression", n.codecType))
+	}
+	cc.SetCompression(comp, threshold)
+	return c, nil
+}
+
+type handshakeWriter struct {
+	bytes.Buffer
+}
+
+func (w *handshakeWriter) uint8(v uint8) {
+	w.WriteByte(v)
+}
+
+func (w *handshakeWriter) string8(s string) {
+	w.uint8(uint8(len(s)))
+	w.WriteString(s)
+}
+
+func (w *handshakeWriter) strings8(ss []string) {
+	w.uint8(uint8(len(ss)))
+	for _, s := range ss {
+		w.string8(s)
+	}
+}
+
+// handshakeReader 读取握手消息，出错之后的读取都会被忽略，只需在最后检查err
+type handshakeReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *handshakeReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, buf)
+	return buf
+}
+
+func (r *handshakeReader) uint8() uint8 {
+	if b := r.read(1); r.err == nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *handshakeReader) uint32() uint32 {
+	if b := r.read(4); r.err == nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *handshakeReader) string8() string {
+	return string(r.read(int(r.uint8())))
+}
+
+func (r *handshakeReader) strings8() []string {
+	n := int(r.uint8())
+	var ss []string
+	for i := 0; i < n && r.err == nil; i++ {
+		ss = append(ss, r.string8())
+	}
+	return ss
+}
+
+func checkName(name string) error {
+	if len(name) == 0 || len(name) > 255 {
+		return errors.New(fmt.Sprintf("invalid handshake name: %q", name))
+	}
+	return nil
+}
+
+func writeHello(w io.Writer, h *hello) error {
+	if len(h.codecs) > 255 || len(h.features) > 255 {
+		return errors.New("too many codecs or features in handshake")
+	}
+	names := append(append([]string{}, h.codecs...), h.features...)
+	for _, name := range names {
+		if err := checkName(name); err != nil {
+			return err
+		}
+	}
+	var buf handshakeWriter
+	_ = binary.Write(&buf, binary.BigEndian, uint32(MagicNumber))
+	buf.uint8(h.version)
+	buf.strings8(h.codecs)
+	buf.strings8(h.features)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// 读取客户端的hello，magic不匹配说明不是toyrpc的连接
+func readHello(r io.Reader) (*hello, error) {
+	hr := &handshakeReader{r: r}
+	if magic := hr.uint32(); hr.err == nil && magic != MagicNumber {
+		return nil, errors.New(fmt.Sprintf("unknown magic number: %#x", magic))
+	}
+	h := &hello{
+		version:  hr.uint8(),
+		codecs:   hr.strings8(),
+		features: hr.strings8(),
+	}
+	if hr.err != nil {
+		return nil, errors.WithMessage(hr.err, "read hello fail")
+	}
+	return h, nil
+}
+
+func writeAck(w io.Writer, ack *helloAck) error {
+	var buf handshakeWriter
+	_ = binary.Write(&buf, binary.BigEndian, uint32(MagicNumber))
+	buf.uint8(ack.version)
+	if ack.accepted {
+		buf.uint8(ackAccepted)
+		buf.string8(ack.codec)
+		buf.strings8(ack.features)
+	} else {
+		buf.uint8(ackRejected)
+		reason := ack.reason
+		if len(reason) > 0xffff {
+			reason = reason[:0xffff]
+		}
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(reason)))
+		buf.WriteString(reason)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// 读取服务端的ack，服务端拒绝时返回ErrHandshakeRejected以及拒绝的原因
+func readAck(r io.Reader) (*helloAck, error) {
+	hr := &handshakeReader{r: r}
+	if magic := hr.uint32(); hr.err == nil && magic != MagicNumber {
+		return nil, errors.New(fmt.Sprintf("unknown magic number: %#x", magic))
+	}
+	ack := &helloAck{version: hr.uint8()}
+	switch status := hr.uint8(); {
+	case hr.err != nil:
+	case status == ackAccepted:
+		ack.accepted = true
+		ack.codec = hr.string8()
+		ack.features = hr.strings8()
+	default:
+		b := hr.read(2)
+		if hr.err == nil {
+			ack.reason = string(hr.read(int(binary.BigEndian.Uint16(b))))
+		}
+	}
+	if hr.err != nil {
+		return nil, errors.WithMessage(hr.err, "read ack fail")
+	}
+	if !ack.accepted {
+		return nil, errors.WithMessage(ErrHandshakeRejected, ack.reason)
+	}
+	return ack, nil
+}
+
+// 检查服务端的ack是否在客户端hello给出的范围之内，不接受客户端没有提供的版本、编码类型或特性
+func checkAck(h *hello, ack *helloAck) error {
+	if ack.version == 0 || ack.version > h.version {
+		return errors.WithMessagef(ErrHandshakeRejected, "server chooses an unoffered version: %d", ack.version)
+	}
+	if !contains(h.codecs, ack.codec) {
+		return errors.WithMessagef(ErrHandshakeRejected, "server chooses an unoffered codec: %s", ack.codec)
+	}
+	for _, f := range ack.features {
+		if !contains(h.features, f) {
+			return errors.WithMessagef(ErrHandshakeRejected, "server chooses an unoffered feature: %s", f)
+		}
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据客户端的hello选择版本、编码类型以及特性，无法满足时拒绝
+func (s *Server) negotiate(h *hello) *helloAck {
+	if h.version == 0 {
+		return &helloAck{version: HandshakeVersion, reason: fmt.Sprintf("unsupported protocol version: %d", h.version)}
+	}
+	// 使用双方都支持的最高版本
+	ack := &helloAck{version: h.version, accepted: true}
+	if ack.version > HandshakeVersion {
+		ack.version = HandshakeVersion
+	}
+	// 按照客户端的优先级选择第一个服务端支持并且允许的编码类型
+	for _, name := range h.codecs {
+		if s.codecs != nil && !s.codecs[name] {
+			continue
+		}
+		if _, err := codec.Get(name); err == nil {
+			ack.codec = name
+			break
+		}
+	}
+	if ack.codec == "" {
+		return &helloAck{version: ack.version, reason: fmt.Sprintf("unsupported codecs: [%s]", strings.Join(h.codecs, ", "))}
+	}
+	// 多个压缩方式只启用客户端最优先的一个
+	compressing := false
+	for _, f := range h.features {
+		if !s.features[f] {
+			continue
+		}
+		if strings.HasPrefix(f, compressFeaturePrefix) {
+			if compressing {
+				continue
+			}
+			compressing = true
+		}
+		ack.features = append(ack.features, f)
+	}
+	return ack
+}
@@ -0,0 +1,76 @@
+package toyrpc
+
+import (
+	"context"
+)
+
+// MethodInfo 被调用方法的信息，供拦截器使用
+type MethodInfo struct {
+	Service        string
+	Method         string
+	IsServerStream bool // 服务端是否流式发送，服务端流式方法的reply为流参数
+	IsClientStream bool // 客户端是否流式发送，客户端流式以及双向流式方法的args为流参数
+}
+
+// Handler 处理一次调用，拦截器调用next来执行后面的拦截器以及方法本身
+type Handler func(ctx context.Context, args, reply any) error
+
+// SvrInterceptor 服务端拦截器，包裹在服务方法的调用外层
+// 拦截器可以在调用next前后加入鉴权、日志、监控等逻辑，也可以不调用next直接返回错误
+type SvrInterceptor func(ctx context.Context, info *MethodInfo, args, reply any, next Handler) error
+
+// WithSvrInterceptors 设置服务端拦截器，按照传入的顺序由外到内执行
+func WithSvrInterceptors(interceptors ...SvrInterceptor) SvrOption {
+	return func(s *Server) {
+		s.interceptors = append(s.interceptors, interceptors...)
+	}
+}
+
+// 将拦截器串联成一个Handler，第一个拦截器在最外层
+func chainSvrInterceptors(interceptors []SvrInterceptor, info *MethodInfo, final Handler) Handler {
+	h := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(ctx context.Context, args, reply any) error {
+			return interceptor(ctx, info, args, reply, next)
+		}
+	}
+	return h
+}
+
+// CallInfo 客户端一次调用的信息，供拦截器使用
+type CallInfo struct {
+	Service string
+	Method  string
+	Addr    string // 本次调用选中的服务实例地址，在拦截器调用invoker选取实例之后才被设置
+	OneWay  bool   // 是否为单向调用，此时reply为nil
+	// 流式调用时拦截器只包裹流的建立，此时reply为nil，之后流上的消息不经过拦截器
+	IsServerStream bool // 服务端是否流式发送
+	IsClientStream bool // 客户端是否流式发送，此时args为nil
+}
+
+// Invoker 发起一次调用，拦截器调用invoker来执行后面的拦截器以及真正的调用
+type Invoker func(ctx context.Context, args, reply any) error
+
+// CliInterceptor 客户端拦截器，包裹在Client.Call的外层，其返回值即为调用结果
+// 服务实例的发现与选取在invoker之内，其失败同样会经过拦截器
+type CliInterceptor func(ctx context.Context, info *CallInfo, args, reply any, invoker Invoker) error
+
+// WithInterceptors 设置客户端拦截器，按照传入的顺序由外到内执行
+func WithInterceptors(interceptors ...CliInterceptor) CliOpt {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
+
+// 将拦截器串联成一个Invoker，第一个拦截器在最外层
+func chainCliInterceptors(interceptors []CliInterceptor, info *CallInfo, final Invoker) Invoker {
+	invoker := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, args, reply any) error {
+			return interceptor(ctx, info, args, reply, next)
+		}
+	}
+	return invoker
+}
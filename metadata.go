@@ -0,0 +1,116 @@
+package toyrpc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Metadata 随调用一起传递的键值对，例如鉴权token、租户ID、trace ID等
+type Metadata map[string]string
+
+// Get 获取key对应的值，不存在时返回空字符串
+func (md Metadata) Get(key string) string {
+	return md[key]
+}
+
+// Set 设置key对应的值
+func (md Metadata) Set(key, value string) {
+	md[key] = value
+}
+
+// Copy 返回一个副本
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	ret := make(Metadata, len(md))
+	for k, v := range md {
+		ret[k] = v
+	}
+	return ret
+}
+
+type (
+	outgoingMetadataKey struct{}
+	incomingMetadataKey struct{}
+	trailerKey          struct{}
+	trailerReceiverKey  struct{}
+)
+
+// WithOutgoingMetadata 返回一个附带元数据的ctx，使用该ctx发起的调用会将元数据发送给服务端
+// ctx中已经存在的元数据会与md合并，相同的key以md为准
+func WithOutgoingMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := OutgoingMetadata(ctx).Copy()
+	if merged == nil {
+		merged = make(Metadata, len(md))
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, outgoingMetadataKey{}, merged)
+}
+
+// OutgoingMetadata 获取ctx中将要发送给服务端的元数据，不存在时返回nil
+// 返回值不应被修改，需要修改时使用WithOutgoingMetadata
+func OutgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingMetadataKey{}).(Metadata)
+	return md
+}
+
+// IncomingMetadata 在服务方法或服务端拦截器中获取客户端发送的元数据，不存在时返回nil
+func IncomingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingMetadataKey{}).(Metadata)
+	return md
+}
+
+// trailer 服务端设置的、随返回一起发送给客户端的元数据
+type trailer struct {
+	mu *sync.Mutex
+	md Metadata
+}
+
+func (t *trailer) get() Metadata {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.md.Copy()
+}
+
+// SetTrailer 在服务方法或服务端拦截器中设置随返回发送给客户端的元数据，多次调用会合并
+func SetTrailer(ctx context.Context, md Metadata) error {
+	t, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return errors.New("no trailer in context, SetTrailer should be called in service method")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.md == nil {
+		t.md = make(Metadata, len(md))
+	}
+	for k, v := range md {
+		t.md[k] = v
+	}
+	return nil
+}
+
+// WithTrailer 返回一个新的ctx，使用该ctx发起的调用返回后，服务端设置的trailer会写入md
+func WithTrailer(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, trailerReceiverKey{}, md)
+}
+
+// 构造服务端调用的ctx，附带客户端发送的元数据以及用于设置trailer的容器
+func newIncomingContext(ctx context.Context, md map[string]string) (context.Context, *trailer) {
+	if len(md) > 0 {
+		ctx = context.WithValue(ctx, incomingMetadataKey{}, Metadata(md))
+	}
+	t := &trailer{mu: new(sync.Mutex)}
+	return context.WithValue(ctx, trailerKey{}, t), t
+}
+
+// 将返回中的trailer交给调用方
+func receiveTrailer(ctx context.Context, md map[string]string) {
+	if receiver, ok := ctx.Value(trailerReceiverKey{}).(*Metadata); ok && receiver != nil {
+		*receiver = md
+	}
+}
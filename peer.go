@@ -0,0 +1,43 @@
+package toyrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Peer 调用方的信息，服务方法可以通过PeerFromContext获取
+type Peer struct {
+	Addr net.Addr
+	TLS  *tls.ConnectionState // 连接使用TLS时不为nil
+}
+
+// Identity 返回客户端证书中的Common Name，客户端没有提供经过验证的证书时返回空字符串
+func (p *Peer) Identity() string {
+	if p.TLS == nil || len(p.TLS.VerifiedChains) == 0 || len(p.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return p.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+type peerKey struct{}
+
+func newPeerContext(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// PeerFromContext 获取调用方的信息，用于按照调用方的身份进行鉴权
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+// 连接上调用方的信息，TLS握手需要已经完成
+func peerOf(netConn net.Conn) *Peer {
+	p := &Peer{Addr: netConn.RemoteAddr()}
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		p.TLS = &state
+	}
+	return p
+}
@@ -80,10 +80,7 @@ func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			ErrorLogger.Printf("Unmarshal body fail: %s\n", err)
 			_, _ = w.Write([]byte(fmt.Sprintf("unmarshal body fail: %s\n", err)))
 		}
-		// 获取请求的ip地址
-		lastIndex := strings.LastIndex(req.RemoteAddr, ":")
-		reqIP := req.RemoteAddr[:lastIndex]
-		res.ServiceAddr = reqIP + res.ServiceAddr
+		res.ServiceAddr = serviceAddr(req, res.ServiceAddr)
 		// 更新对应服务实例的最后更新时间
 		si, ok := r.services[res.ServiceName]
 		// 服务实例信息存在
@@ -109,11 +106,36 @@ func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			r.services[res.ServiceName].addresses[res.ServiceAddr] = time.Now()
 			CommonLogger.Printf("Register service [%s %s]\n", res.ServiceName, res.ServiceAddr)
 		}
+	// DELETE方法用于服务器关闭时注销服务实例
+	case http.MethodDelete:
+		var res = new(svcUpdateMapping)
+		if err := json.NewDecoder(req.Body).Decode(res); err != nil {
+			ErrorLogger.Printf("Decode body fail: %s\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		res.ServiceAddr = serviceAddr(req, res.ServiceAddr)
+		r.mu.Lock()
+		if si, ok := r.services[res.ServiceName]; ok {
+			delete(si.addresses, res.ServiceAddr)
+		}
+		r.mu.Unlock()
+		CommonLogger.Printf("Deregister service [%s %s]\n", res.ServiceName, res.ServiceAddr)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// 服务器上报的tcp地址为":port"的形式，使用请求的ip地址补全
+// 其他网络类型的地址为"network@address"的形式，例如"unix@/tmp/toyrpc.sock"，原样保存
+func serviceAddr(req *http.Request, addr string) string {
+	if !strings.HasPrefix(addr, ":") {
+		return addr
+	}
+	lastIndex := strings.LastIndex(req.RemoteAddr, ":")
+	return req.RemoteAddr[:lastIndex] + addr
+}
+
 func (r *Registry) Start() {
 	http.Handle(DefaultRegisterPath, r)
 	CommonLogger.Printf("Registry successfully starting at: %s\n", r.port)
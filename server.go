@@ -2,6 +2,8 @@ package toyrpc
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"go/ast"
@@ -9,6 +11,7 @@ import (
 	"net/http"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/2evl1u/toyrpc/log"
@@ -24,13 +27,49 @@ type Server struct {
 	registry          string
 	serviceMap        sync.Map
 	heartbeatInterval time.Duration
+	listener          net.Listener
+	mu                *sync.Mutex // 保护listener和conns
+	conns             map[*connection]struct{}
+	inShutdown        atomic.Bool   // 是否正在关闭
+	done              chan struct{} // 关闭时close，用于通知心跳等后台goroutine退出
+	closeOnce         *sync.Once
+	interceptors      []SvrInterceptor
+	recoverPanic      bool            // 是否恢复服务方法中的panic，否则panic会导致整个进程退出
+	features          map[string]bool // 服务端支持的特性，握手时启用客户端同样支持的部分
+	compressThreshold int             // 客户端要求压缩时，不小于该字节数的返回才会被压缩
+	codecs            map[string]bool // 允许客户端使用的编码类型，为nil表示接受所有已注册的编码类型
+	tlsConfig         *tls.Config     // 不为nil时连接使用TLS
 }
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 type service struct {
 	name string
 	self reflect.Value
-	mm   map[string]*reflect.Method
+	mm   map[string]*methodType
 	svr  *Server
+
+	aliveOnce sync.Once // 保证心跳goroutine只启动一次
+}
+
+// methodType 一个被注册的rpc方法
+type methodType struct {
+	reflect.Method
+	argType   reflect.Type
+	replyType reflect.Type
+	withCtx   bool       // 第一个入参是否为context.Context
+	kind      streamKind // 调用方式，流式方法的argType为接收的消息类型，replyType为发送的消息类型
+}
+
+// 流式方法中流参数的类型
+func (m *methodType) streamParamType() reflect.Type {
+	if m.kind == serverStreaming {
+		return m.Type.In(m.Type.NumIn() - 1)
+	}
+	return m.Type.In(1)
 }
 
 type SvrOption func(server *Server)
@@ -47,13 +86,59 @@ func WithSvrAddress(address string) SvrOption {
 	}
 }
 
+// WithSvrRecover 设置是否恢复服务方法中的panic，默认恢复
+// 恢复时panic会被转换为CodePanic的Status返回给客户端，关闭时panic会使整个进程退出
+func WithSvrRecover(recover bool) SvrOption {
+	return func(s *Server) {
+		s.recoverPanic = recover
+	}
+}
+
+// WithSvrCompressThreshold 设置压缩的阈值，客户端要求压缩时，不小于threshold字节的返回才会被压缩
+func WithSvrCompressThreshold(threshold int) SvrOption {
+	return func(s *Server) {
+		s.compressThreshold = threshold
+	}
+}
+
+// WithSvrCodecs 限制客户端可以使用的编码类型，不在其中的编码类型即使已经注册也会在握手时被拒绝
+func WithSvrCodecs(codecTypes ...string) SvrOption {
+	return func(s *Server) {
+		s.codecs = make(map[string]bool, len(codecTypes))
+		for _, name := range codecTypes {
+			s.codecs[name] = true
+		}
+	}
+}
+
+// WithSvrTLSConfig 使用TLS加密连接，需要验证客户端证书（mTLS）时设置config的ClientAuth与ClientCAs
+// 客户端的身份可以在服务方法中通过PeerFromContext获取
+func WithSvrTLSConfig(config *tls.Config) SvrOption {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
 // NewServer 如果不指定网络类型，默认tcp；如果不指定端口，则默认7788端口
+// 网络类型可以为unix，此时address为socket文件的路径；也可以为PipeNetwork，此时address为进程内的名字
+// registry为空时不向注册中心注册
 func NewServer(registry string, opts ...SvrOption) *Server {
 	svr := &Server{
 		network:           DefaultNetwork,
 		address:           DefaultAddr,
 		registry:          registry,
 		heartbeatInterval: DefaultServerHeartbeatInterval,
+		mu:                new(sync.Mutex),
+		conns:             make(map[*connection]struct{}),
+		done:              make(chan struct{}),
+		closeOnce:         new(sync.Once),
+		recoverPanic:      true,
+		features:          make(map[string]bool),
+		compressThreshold: DefaultCompressThreshold,
+	}
+	// 支持所有内置的压缩方式，由客户端决定是否启用
+	for _, name := range codec.Compressors() {
+		svr.features[compressFeature(name)] = true
 	}
 	for _, opt := range opts {
 		opt(svr)
@@ -61,61 +146,190 @@ func NewServer(registry string, opts ...SvrOption) *Server {
 	return svr
 }
 
-func (s *Server) Start() {
-	listener, err := net.Listen(s.network, s.address)
-	// 启动监听失败，直接panic
+// Start 按照network和address创建监听并开始服务，监听失败时返回错误
+func (s *Server) Start() error {
+	listener, err := listen(s.network, s.address)
 	if err != nil {
-		ErrorLogger.Panic(err)
+		return errors.WithMessage(err, "listen fail")
+	}
+	return s.Serve(listener)
+}
+
+// Serve 在调用方提供的listener上接受连接并提供服务，会一直阻塞直到listener出错或服务器关闭
+// 服务器被Shutdown之后返回ErrServerClosed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.inShutdown.Load() {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
 	}
+	s.listener = listener
+	s.address = advertiseAddr(listener.Addr())
+	s.mu.Unlock()
 	CommonLogger.Printf("Server successfully start at %s\n", listener.Addr().String())
+	// 开始监听之后才向注册中心发送心跳
+	s.serviceMap.Range(func(_, v any) bool {
+		v.(*service).keepAlive()
+		return true
+	})
 	// 循环接受客户端连接
 	for {
 		netConn, err := listener.Accept()
-		CommonLogger.Printf("Connect from %s\n", netConn.RemoteAddr().String())
-		// 某个连接失败，就close掉，然后跳过接着等待连接
 		if err != nil {
-			_ = netConn.Close()
-			ErrorLogger.Printf("Listener accept fail: %s, remote port: %s\n", err, netConn.RemoteAddr().String())
-			continue
-		}
-		// 连接正常建立之后，先解码settings，获取标识和消息编码类型
-		// 默认使用json编码来解码settings
-		var settings = new(Settings)
-		if err = json.NewDecoder(netConn).Decode(settings); err != nil {
-			_ = netConn.Close()
-			ErrorLogger.Printf("Decode connect settings fail: %s\n", err)
-			continue
-		}
-		// 判断是不是toyrpc的连接，不是的话直接关闭，打印错误日志
-		if settings.MagicNumber != MagicNumber {
-			_ = netConn.Close()
-			ErrorLogger.Println("Unknown message type")
-			continue
+			// 服务器正在关闭，listener已被关闭，直接退出
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+			// 超时之类的临时错误，跳过接着等待连接
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				ErrorLogger.Printf("Listener accept fail: %s\n", err)
+				continue
+			}
+			return errors.WithMessage(err, "listener accept fail")
 		}
-		// 获取编码类型
-		maker, err := codec.Get(settings.CodecType)
-		if err != nil {
-			_ = netConn.Close()
-			ErrorLogger.Printf("Unknown encoding type: %s\n", settings.CodecType)
-			continue
+		CommonLogger.Printf("Connect from %s\n", netConn.RemoteAddr().String())
+		go s.serveConn(netConn)
+	}
+}
+
+// 处理一个新建立的连接，先协商settings再交给connection处理后续的调用
+func (s *Server) serveConn(netConn net.Conn) {
+	if s.tlsConfig != nil {
+		netConn = tls.Server(netConn, s.tlsConfig)
+	}
+	// 连接正常建立之后，先完成握手，确定协议版本、编码类型以及启用的特性
+	n, err := s.handshake(netConn)
+	if err != nil {
+		_ = netConn.Close()
+		ErrorLogger.Printf("Handshake fail: %s\n", err)
+		return
+	}
+	c, err := n.newCodec(netConn, s.compressThreshold)
+	if err != nil {
+		_ = netConn.Close()
+		ErrorLogger.Printf("Create codec fail: %s\n", err)
+		return
+	}
+	// 新建toyrpc连接，连接关闭时取消其上所有调用的context
+	// 调用方的信息放在连接的context中，所有调用的context都由其派生
+	ctx, cancel := context.WithCancel(newPeerContext(context.Background(), peerOf(netConn)))
+	conn := &connection{
+		ctx:     ctx,
+		cancel:  cancel,
+		Codec:   c,
+		sending: new(sync.Mutex),
+		wg:      new(sync.WaitGroup),
+		mu:      new(sync.Mutex),
+		calls:   make(map[uint64]*request),
+		svr:     s,
+	}
+	if !s.trackConn(conn) {
+		cancel()
+		_ = conn.Close()
+		return
+	}
+	conn.handle()
+}
+
+// 读取客户端的hello并回复ack，拒绝时将原因告知客户端
+func (s *Server) handshake(netConn net.Conn) (*negotiated, error) {
+	_ = netConn.SetDeadline(time.Now().Add(DefaultHandshakeTimeout))
+	defer netConn.SetDeadline(time.Time{})
+	// 先完成TLS握手，之后才能获取客户端的证书
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, errors.WithMessage(err, "tls handshake fail")
 		}
-		// 新建toyrpc连接
-		conn := &connection{
-			Codec:   maker(netConn),
-			sending: new(sync.Mutex),
-			wg:      new(sync.WaitGroup),
-			svr:     s,
+	}
+	h, err := readHello(netConn)
+	if err != nil {
+		return nil, err
+	}
+	ack := s.negotiate(h)
+	if err = writeAck(netConn, ack); err != nil {
+		return nil, errors.WithMessage(err, "write ack fail")
+	}
+	if !ack.accepted {
+		return nil, errors.WithMessage(ErrHandshakeRejected, ack.reason)
+	}
+	return newNegotiated(ack), nil
+}
+
+// Shutdown 优雅关闭服务器：
+// 1. 停止接受新连接，并停止向注册中心发送心跳
+// 2. 通知注册中心移除本服务器的地址
+// 3. 等待各连接上正在处理的调用完成，ctx到期则放弃等待
+// 4. 关闭所有连接
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown.Store(true)
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	conns := make([]*connection, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	// 从注册中心注销，注册中心无响应时同样受ctx限制
+	s.serviceMap.Range(func(_, v any) bool {
+		v.(*service).deregister(ctx)
+		return true
+	})
+	// 等待正在进行的调用完成
+	drained := make(chan struct{})
+	go func() {
+		for _, conn := range conns {
+			conn.drain()
 		}
-		go conn.handle()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		ErrorLogger.Printf("Shutdown before all calls finished: %s\n", err)
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	CommonLogger.Println("Server shutdown")
+	return err
+}
+
+// 记录一个活跃连接，服务器正在关闭时返回false
+func (s *Server) trackConn(conn *connection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown.Load() {
+		return false
 	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(conn *connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
 }
 
 // AsService 将一个结构体作为一个服务，会注册特定方法签名的方法
 // 一个方法想要被注册为rpc方法，需要满足以下几个条件:
 // 1. 方法所属类型是导出的
 // 2. 方法本身是导出的
-// 3. 两个入参，均为导出或内置类型，且第二个入参需为指针类型
+// 3. 两个入参，均为导出或内置类型，且第二个入参需为指针类型；也可以在最前面多一个context.Context入参
 // 4. 返回值是error接口类型
+// 流式方法的签名为以下几种，T与R同样需要是导出或内置类型
+// 1. 服务端流式 func(args T, stream toyrpc.ServerStream[R]) error
+// 2. 客户端流式 func(stream toyrpc.ClientStream[T], reply *R) error
+// 3. 双向流式 func(stream toyrpc.BidiStream[T, R]) error
 func (s *Server) AsService(target any) error {
 	// 1 创建服务
 	svc := &service{
@@ -127,26 +341,49 @@ func (s *Server) AsService(target any) error {
 		return errors.New(fmt.Sprintf("%s is not exported", svc.name))
 	}
 	// 2 通过反射寻找符合条件的方法签名
-	svc.mm = make(map[string]*reflect.Method)
+	svc.mm = make(map[string]*methodType)
 	targetType := reflect.TypeOf(target)
 	for i := 0; i < targetType.NumMethod(); i++ {
 		method := targetType.Method(i)
-		// 入参必须为3个，第1个为receiver，第2个为args，第3个为reply
-		if method.Type.NumIn() != 3 || method.Type.NumOut() != 1 {
+		if method.Type.NumOut() != 1 {
 			continue
 		}
 		// 返回值不是error接口类型
-		if method.Type.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		if method.Type.Out(0) != typeOfError {
+			continue
+		}
+		// 流式方法的入参中带有流，例如ServerStream
+		if mt, ok := parseStreamMethod(method); ok {
+			svc.mm[method.Name] = mt
+			continue
+		}
+		// 入参为3个时，第1个为receiver，第2个为args，第3个为reply
+		// 入参为4个时，第2个必须为context.Context
+		var withCtx bool
+		switch method.Type.NumIn() {
+		case 3:
+		case 4:
+			if method.Type.In(1) != typeOfContext {
+				continue
+			}
+			withCtx = true
+		default:
 			continue
 		}
-		// 入参必须是导出或者内置类型
-		argType, replyType := method.Type.In(1), method.Type.In(2)
+		// 入参必须是导出或者内置类型，reply必须是指针类型
+		argType, replyType := method.Type.In(method.Type.NumIn()-2), method.Type.In(method.Type.NumIn()-1)
 		if !(ast.IsExported(argType.Name()) || argType.PkgPath() == "") ||
-			!(ast.IsExported(replyType.Name()) || replyType.PkgPath() == "") {
+			!(ast.IsExported(replyType.Name()) || replyType.PkgPath() == "") ||
+			replyType.Kind() != reflect.Ptr {
 			continue
 		}
 		// 注册方法
-		svc.mm[method.Name] = &method
+		svc.mm[method.Name] = &methodType{
+			Method:    method,
+			argType:   argType,
+			replyType: replyType,
+			withCtx:   withCtx,
+		}
 	}
 	// 3 注册服务
 	if _, existed := s.serviceMap.LoadOrStore(svc.name, svc); existed {
@@ -157,22 +394,41 @@ func (s *Server) AsService(target any) error {
 		nameSli = append(nameSli, name)
 	}
 	CommonLogger.Printf("Register service: %s. Methods as followed: %s\n", svc.name, nameSli)
-	// 向注册中心发送心跳
-	svc.heartbeat()
-	go func() {
-		// 心跳的间隔比服务器超时间隔稍短
-		ticker := time.NewTicker(s.heartbeatInterval)
-		for {
-			select {
-			case <-ticker.C:
-				svc.heartbeat()
-				CommonLogger.Println("Send heartbeat to registry")
-			}
-		}
-	}()
+	// 服务器已经开始监听，则立即向注册中心发送心跳，否则等到Serve时再发送
+	s.mu.Lock()
+	serving := s.listener != nil
+	s.mu.Unlock()
+	if serving {
+		svc.keepAlive()
+	}
 	return nil
 }
 
+// 向注册中心发送心跳并定时续约，多次调用只会生效一次
+// 没有设置注册中心时不注册，客户端需要通过WithServerAddrs直接连接
+func (s *service) keepAlive() {
+	if s.svr.registry == "" {
+		return
+	}
+	s.aliveOnce.Do(func() {
+		s.heartbeat()
+		go func() {
+			// 心跳的间隔比服务器超时间隔稍短
+			ticker := time.NewTicker(s.svr.heartbeatInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.heartbeat()
+					CommonLogger.Println("Send heartbeat to registry")
+				case <-s.svr.done:
+					return
+				}
+			}
+		}()
+	})
+}
+
 // 发送心跳，指示注册中心该服务存活
 func (s *service) heartbeat() {
 	body := svcUpdateMapping{
@@ -184,8 +440,37 @@ func (s *service) heartbeat() {
 	resp, err := http.Post(s.svr.registry+DefaultRegisterPath, "application/json", buffer)
 	if err != nil {
 		ErrorLogger.Printf("Send heartbeat post request fail: %s\n", err)
+		return
 	}
+	_ = resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		ErrorLogger.Printf("Heartbeat response err, status code: %d\n", resp.StatusCode)
 	}
 }
+
+// 通知注册中心移除该服务在本服务器上的实例
+func (s *service) deregister(ctx context.Context) {
+	if s.svr.registry == "" {
+		return
+	}
+	body := svcUpdateMapping{
+		ServiceName: s.name,
+		ServiceAddr: s.svr.address,
+	}
+	bs, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.svr.registry+DefaultRegisterPath, bytes.NewBuffer(bs))
+	if err != nil {
+		ErrorLogger.Printf("Create deregister request fail: %s\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ErrorLogger.Printf("Send deregister request fail: %s\n", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		ErrorLogger.Printf("Deregister response err, status code: %d\n", resp.StatusCode)
+	}
+}
@@ -0,0 +1,145 @@
+package toyrpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/2evl1u/toyrpc/codec"
+
+	"github.com/pkg/errors"
+)
+
+// StatusCode 随返回一起发送的错误码，客户端据此区分不同的错误，决定是否重试
+type StatusCode uint32
+
+const (
+	CodeOK                StatusCode = iota // 调用成功
+	CodeUnknown                             // 未知错误，服务方法返回的普通error均为此错误码
+	CodePanic                               // 服务方法发生了panic
+	CodeServiceNotFound                     // 请求的服务不存在
+	CodeMethodNotFound                      // 请求的方法不存在
+	CodeCanceled                            // 调用被取消
+	CodeDeadlineExceeded                    // 调用超过了截止时间
+	CodeInvalidArgument                     // 参数不合法
+	CodeNotFound                            // 请求的资源不存在
+	CodeAlreadyExists                       // 要创建的资源已经存在
+	CodePermissionDenied                    // 没有权限
+	CodeUnauthenticated                     // 未通过身份认证
+	CodeResourceExhausted                   // 资源耗尽，例如触发限流
+	CodeUnavailable                         // 服务暂时不可用，通常可以重试
+	CodeInternal                            // 服务内部错误
+)
+
+var codeNames = map[StatusCode]string{
+	CodeOK:                "OK",
+	CodeUnknown:           "Unknown",
+	CodePanic:             "Panic",
+	CodeServiceNotFound:   "ServiceNotFound",
+	CodeMethodNotFound:    "MethodNotFound",
+	CodeCanceled:          "Canceled",
+	CodeDeadlineExceeded:  "DeadlineExceeded",
+	CodeInvalidArgument:   "InvalidArgument",
+	CodeNotFound:          "NotFound",
+	CodeAlreadyExists:     "AlreadyExists",
+	CodePermissionDenied:  "PermissionDenied",
+	CodeUnauthenticated:   "Unauthenticated",
+	CodeResourceExhausted: "ResourceExhausted",
+	CodeUnavailable:       "Unavailable",
+	CodeInternal:          "Internal",
+}
+
+func (c StatusCode) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// 以下错误可以在客户端使用errors.Is判断，错误码相同即视为匹配
+var (
+	ErrPanic           = NewStatus(CodePanic, "service method panicked")
+	ErrServiceNotFound = NewStatus(CodeServiceNotFound, "service not found")
+	ErrMethodNotFound  = NewStatus(CodeMethodNotFound, "method not found")
+	ErrServerClosed    = NewStatus(CodeUnavailable, "server is closed") // Serve在关闭后返回，正在关闭的服务器也以此拒绝新的调用
+)
+
+// Status 调用的状态，由错误码、描述信息以及可选的结构化详情组成
+// 服务方法可以直接返回Status作为错误，客户端Call返回的服务端错误也均为Status
+type Status struct {
+	Code    StatusCode
+	Message string
+	Details map[string]string // 可选的结构化详情，例如出错的字段、重试间隔等
+}
+
+// NewStatus 新建一个Status
+func NewStatus(code StatusCode, msg string) *Status {
+	return &Status{Code: code, Message: msg}
+}
+
+// Errorf 新建一个以Status为错误的error
+func Errorf(code StatusCode, format string, a ...any) error {
+	return NewStatus(code, fmt.Sprintf(format, a...))
+}
+
+// WithDetails 返回一个附带了详情的副本
+func (s *Status) WithDetails(details map[string]string) *Status {
+	ret := *s
+	ret.Details = make(map[string]string, len(s.Details)+len(details))
+	for k, v := range s.Details {
+		ret.Details[k] = v
+	}
+	for k, v := range details {
+		ret.Details[k] = v
+	}
+	return &ret
+}
+
+func (s *Status) Error() string {
+	return s.Message
+}
+
+// Is 错误码相同即视为同一种错误
+func (s *Status) Is(target error) bool {
+	t, ok := target.(*Status)
+	return ok && t.Code == s.Code
+}
+
+// FromError 从错误链中取出Status，不存在时返回false
+func FromError(err error) (*Status, bool) {
+	var s *Status
+	if errors.As(err, &s) {
+		return s, true
+	}
+	return nil, false
+}
+
+// Code 获取错误对应的错误码，err为nil时返回CodeOK
+func Code(err error) StatusCode {
+	if err == nil {
+		return CodeOK
+	}
+	if s, ok := FromError(err); ok {
+		return s.Code
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	}
+	return CodeUnknown
+}
+
+// 将错误写入返回的header
+func setHeaderError(h *codec.Header, err error) {
+	h.Err = err.Error()
+	h.Code = uint32(Code(err))
+	if s, ok := FromError(err); ok {
+		h.Details = s.Details
+	}
+}
+
+// 客户端根据返回的header重建错误
+func errorFromHeader(h *codec.Header) error {
+	return &Status{Code: StatusCode(h.Code), Message: h.Err, Details: h.Details}
+}
@@ -0,0 +1,749 @@
+package toyrpc
+
+import (
+	"context"
+	"go/ast"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/2evl1u/toyrpc/log"
+
+	"github.com/2evl1u/toyrpc/codec"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStreamClosed 流已经结束，不能再发送消息
+var ErrStreamClosed = errors.New("stream is closed")
+
+// streamWindowSize 每个流每个方向的初始流量控制窗口，即对方在收到窗口更新之前最多可以发送的消息数
+// 接收方最多只需缓存这么多消息，因此一个处理缓慢的流不会阻塞整个连接
+const streamWindowSize = 16
+
+// streamKind 方法的调用方式
+type streamKind int
+
+const (
+	unaryCall       streamKind = iota // 一个请求对应一个返回
+	serverStreaming                   // 一个请求对应多个返回
+	clientStreaming                   // 多个请求对应一个返回
+	bidiStreaming                     // 双方同时发送多个消息
+)
+
+// Stream 流的基本操作，服务方法一般使用ServerStream等带有类型的包装
+type Stream interface {
+	// Context 调用的context，客户端取消或者超时时结束
+	Context() context.Context
+	// SendMsg 在流上发送一个消息，对方的接收窗口已满时阻塞
+	SendMsg(msg any) error
+	// RecvMsg 接收一个消息，msg需为指针，对方发送完毕时返回io.EOF
+	RecvMsg(msg any) error
+}
+
+// streamParam 流式方法参数需要实现的接口，用于AsService识别方法的调用方式
+type streamParam interface {
+	streamKind() streamKind
+}
+
+var typeOfStreamParam = reflect.TypeOf((*streamParam)(nil)).Elem()
+
+// ServerStream 服务端流式方法的参数，方法签名为 func(args T, stream toyrpc.ServerStream[R]) error
+// 方法可以多次调用Send向客户端发送消息，方法返回即代表流结束
+type ServerStream[R any] struct {
+	Stream
+}
+
+// Send 向客户端发送一个消息
+func (s ServerStream[R]) Send(msg R) error {
+	return s.SendMsg(msg)
+}
+
+func (ServerStream[R]) streamKind() streamKind {
+	return serverStreaming
+}
+
+// ClientStream 客户端流式方法的参数，方法签名为 func(stream toyrpc.ClientStream[T], reply *R) error
+// 方法通过Recv依次接收客户端发送的消息，客户端发送完毕时Recv返回io.EOF
+type ClientStream[T any] struct {
+	Stream
+}
+
+// Recv 接收客户端发送的一个消息
+func (s ClientStream[T]) Recv() (T, error) {
+	var msg T
+	err := s.RecvMsg(&msg)
+	return msg, err
+}
+
+func (ClientStream[T]) streamKind() streamKind {
+	return clientStreaming
+}
+
+// BidiStream 双向流式方法的参数，方法签名为 func(stream toyrpc.BidiStream[T, R]) error
+// 方法可以同时接收T类型的消息以及发送R类型的消息，方法返回即代表流结束
+type BidiStream[T, R any] struct {
+	Stream
+}
+
+// Recv 接收客户端发送的一个消息
+func (s BidiStream[T, R]) Recv() (T, error) {
+	var msg T
+	err := s.RecvMsg(&msg)
+	return msg, err
+}
+
+// Send 向客户端发送一个消息
+func (s BidiStream[T, R]) Send(msg R) error {
+	return s.SendMsg(msg)
+}
+
+func (BidiStream[T, R]) streamKind() streamKind {
+	return bidiStreaming
+}
+
+// 识别流式方法的参数类型，返回调用方式、接收的消息类型以及发送的消息类型
+func parseStreamParam(t reflect.Type) (kind streamKind, recvType, sendType reflect.Type, ok bool) {
+	if t.Kind() != reflect.Struct || !t.Implements(typeOfStreamParam) {
+		return unaryCall, nil, nil, false
+	}
+	kind = reflect.Zero(t).Interface().(streamParam).streamKind()
+	if recv, ok := t.MethodByName("Recv"); ok {
+		recvType = recv.Type.Out(0)
+	}
+	if send, ok := t.MethodByName("Send"); ok {
+		sendType = send.Type.In(1)
+	}
+	return kind, recvType, sendType, true
+}
+
+// 识别流式方法，非流式方法返回false
+func parseStreamMethod(method reflect.Method) (*methodType, bool) {
+	mt := method.Type
+	isExported := func(t reflect.Type) bool {
+		return ast.IsExported(t.Name()) || t.PkgPath() == ""
+	}
+	switch mt.NumIn() {
+	case 2:
+		// func(stream BidiStream[T, R]) error
+		if kind, recvType, sendType, ok := parseStreamParam(mt.In(1)); ok && kind == bidiStreaming {
+			return &methodType{Method: method, argType: recvType, replyType: sendType, kind: kind}, true
+		}
+	case 3:
+		// func(args T, stream ServerStream[R]) error
+		if kind, _, sendType, ok := parseStreamParam(mt.In(2)); ok && kind == serverStreaming && isExported(mt.In(1)) {
+			return &methodType{Method: method, argType: mt.In(1), replyType: sendType, kind: kind}, true
+		}
+		// func(stream ClientStream[T], reply *R) error
+		if kind, recvType, _, ok := parseStreamParam(mt.In(1)); ok && kind == clientStreaming &&
+			isExported(mt.In(2)) && mt.In(2).Kind() == reflect.Ptr {
+			return &methodType{Method: method, argType: recvType, replyType: mt.In(2), kind: kind}, true
+		}
+	}
+	return nil, false
+}
+
+// 构造传给流式方法的参数
+func newStreamParam(t reflect.Type, s Stream) reflect.Value {
+	v := reflect.New(t).Elem()
+	v.Field(0).Set(reflect.ValueOf(&s).Elem())
+	return v
+}
+
+// flowWindow 发送方的流量控制窗口，每发送一个消息消耗一个额度，额度由接收方通过窗口更新归还
+type flowWindow struct {
+	mu     *sync.Mutex
+	avail  uint32
+	signal chan struct{} // 额度增加时通知等待的发送方
+}
+
+func newFlowWindow() *flowWindow {
+	return &flowWindow{
+		mu:     new(sync.Mutex),
+		avail:  streamWindowSize,
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// 获取一个发送额度，没有额度时阻塞，直到done被关闭
+func (w *flowWindow) acquire(done <-chan struct{}) bool {
+	for {
+		// 流已经结束时即使还有额度也不能再发送
+		select {
+		case <-done:
+			return false
+		default:
+		}
+		w.mu.Lock()
+		if w.avail > 0 {
+			w.avail--
+			w.mu.Unlock()
+			return true
+		}
+		w.mu.Unlock()
+		select {
+		case <-w.signal:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// 归还发送额度
+func (w *flowWindow) add(n uint32) {
+	w.mu.Lock()
+	w.avail += n
+	w.mu.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// msgQueue 流上收到的消息，调用方取走消息之后通过update向对方归还发送额度
+type msgQueue struct {
+	msgs     chan any
+	eof      chan struct{} // 对方不再发送消息时被关闭
+	eofOnce  *sync.Once
+	mu       *sync.Mutex
+	consumed uint32         // 已经取走但还未归还的额度
+	update   func(n uint32) // 向对方发送窗口更新
+}
+
+func newMsgQueue(update func(n uint32)) *msgQueue {
+	return &msgQueue{
+		msgs:    make(chan any, streamWindowSize),
+		eof:     make(chan struct{}),
+		eofOnce: new(sync.Once),
+		mu:      new(sync.Mutex),
+		update:  update,
+	}
+}
+
+// 放入一个消息，队列已满说明对方没有遵守流量控制，返回false
+func (q *msgQueue) push(msg any) bool {
+	select {
+	case q.msgs <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// 对方不再发送消息
+func (q *msgQueue) close() {
+	q.eofOnce.Do(func() {
+		close(q.eof)
+	})
+}
+
+// 取出一个消息，对方发送完毕并且消息都已取走，或者done被关闭时返回false
+func (q *msgQueue) pop(done <-chan struct{}) (any, bool) {
+	var msg any
+	select {
+	case msg = <-q.msgs:
+	default:
+		select {
+		case msg = <-q.msgs:
+		case <-done:
+			return nil, false
+		case <-q.eof:
+			// 结束之前收到的消息仍然需要交给调用方
+			select {
+			case msg = <-q.msgs:
+			default:
+				return nil, false
+			}
+		}
+	}
+	// 取走一半窗口的消息之后再归还额度，减少窗口更新的次数
+	q.mu.Lock()
+	q.consumed++
+	n := q.consumed
+	if n >= streamWindowSize/2 {
+		q.consumed = 0
+	}
+	q.mu.Unlock()
+	if n >= streamWindowSize/2 {
+		q.update(n)
+	}
+	return msg, true
+}
+
+// svrStream 服务端一个流式调用的流
+type svrStream struct {
+	conn       *connection
+	req        *request
+	closed     bool        // 流已经发送了结束消息，由conn.sending保护
+	sendWindow *flowWindow // 向客户端发送的额度
+	recvq      *msgQueue   // 客户端发送的消息，服务端流式调用为nil
+	newMsg     func() any  // 新建一个用于解码客户端消息的指针
+}
+
+var _ Stream = (*svrStream)(nil)
+
+func newSvrStream(conn *connection, req *request, method *methodType) *svrStream {
+	s := &svrStream{
+		conn:       conn,
+		req:        req,
+		sendWindow: newFlowWindow(),
+	}
+	if method.kind == clientStreaming || method.kind == bidiStreaming {
+		s.recvq = newMsgQueue(s.sendWindowUpdate)
+		s.newMsg = func() any {
+			return reflect.New(method.argType).Interface()
+		}
+	}
+	return s
+}
+
+func (s *svrStream) Context() context.Context {
+	return s.req.ctx
+}
+
+func (s *svrStream) SendMsg(msg any) error {
+	if !s.sendWindow.acquire(s.req.ctx.Done()) {
+		return s.req.ctx.Err()
+	}
+	s.conn.sending.Lock()
+	defer s.conn.sending.Unlock()
+	if s.closed {
+		return ErrStreamClosed
+	}
+	h := &codec.Header{
+		Service: s.req.h.Service,
+		Method:  s.req.h.Method,
+		SeqId:   s.req.h.SeqId,
+		Type:    codec.MsgStreamData,
+	}
+	if err := s.conn.Write(h, msg); err != nil {
+		return errors.WithMessage(err, "stream write fail")
+	}
+	return nil
+}
+
+func (s *svrStream) RecvMsg(msg any) error {
+	if s.recvq == nil {
+		return io.EOF
+	}
+	v, ok := s.recvq.pop(s.req.ctx.Done())
+	if !ok {
+		if err := s.req.ctx.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	reflect.ValueOf(msg).Elem().Set(reflect.ValueOf(v).Elem())
+	return nil
+}
+
+// 告知客户端可以继续发送n个消息
+func (s *svrStream) sendWindowUpdate(n uint32) {
+	s.conn.sending.Lock()
+	defer s.conn.sending.Unlock()
+	if s.closed {
+		return
+	}
+	h := &codec.Header{SeqId: s.req.h.SeqId, Type: codec.MsgWindowUpdate, Window: n}
+	if err := s.conn.Write(h, invalidBody); err != nil {
+		ErrorLogger.Printf("Send window update fail: %s\n", err)
+	}
+}
+
+// 是否为流上的消息，而不是一个新的调用
+func isStreamMsg(t codec.MsgType) bool {
+	return t == codec.MsgStreamData || t == codec.MsgStreamHalfClose || t == codec.MsgWindowUpdate
+}
+
+// 处理客户端在流上发送的消息
+func (conn *connection) dispatchStream(h *codec.Header) error {
+	conn.mu.Lock()
+	req := conn.calls[h.SeqId]
+	conn.mu.Unlock()
+	// 调用已经结束，丢弃消息
+	if req == nil || req.stream == nil {
+		return conn.ReadBody(nil)
+	}
+	s := req.stream
+	switch h.Type {
+	case codec.MsgStreamData:
+		if s.recvq == nil {
+			return conn.ReadBody(nil)
+		}
+		msg := s.newMsg()
+		// 消息解码失败时放弃该调用，连接上的其他调用不受影响
+		if err := conn.ReadBody(msg); err != nil {
+			ErrorLogger.Printf("Stream %s.%s read message fail: %s\n", h.Service, h.Method, err)
+			req.abort(NewStatus(CodeInvalidArgument, err.Error()))
+			return nil
+		}
+		if !s.recvq.push(msg) {
+			ErrorLogger.Printf("Stream %s.%s exceeds flow control window, cancel it\n", h.Service, h.Method)
+			req.abort(NewStatus(CodeResourceExhausted, "stream exceeds flow control window"))
+		}
+	case codec.MsgStreamHalfClose:
+		if s.recvq != nil {
+			s.recvq.close()
+		}
+		return conn.ReadBody(nil)
+	case codec.MsgWindowUpdate:
+		s.sendWindow.add(h.Window)
+		return conn.ReadBody(nil)
+	default:
+		return conn.ReadBody(nil)
+	}
+	return nil
+}
+
+// cliStream 客户端一个流式调用的流
+type cliStream struct {
+	cli        *client
+	service    string
+	method     string
+	seq        uint64
+	newMsg     func() any    // 新建一个用于解码服务端消息的指针
+	reply      any           // 客户端流式调用的返回，随结束消息一起发送
+	recvq      *msgQueue     // 服务端发送的消息
+	sendWindow *flowWindow   // 向服务端发送的额度
+	halfClosed atomic.Bool   // 客户端已经发送完毕
+	end        chan struct{} // 流结束时被关闭
+	endOnce    *sync.Once
+	err        error             // 流结束的原因，正常结束时为nil
+	trailer    map[string]string // 服务端随结束消息发送的trailer
+}
+
+// 注册并发起一个流式调用，ctx结束时会通知服务端取消
+func (cli *client) openStream(ctx context.Context, serviceName, methodName string, args any, newMsg func() any, reply any) (*cliStream, error) {
+	st := &cliStream{
+		cli:        cli,
+		service:    serviceName,
+		method:     methodName,
+		newMsg:     newMsg,
+		reply:      reply,
+		sendWindow: newFlowWindow(),
+		end:        make(chan struct{}),
+		endOnce:    new(sync.Once),
+	}
+	st.recvq = newMsgQueue(st.sendWindowUpdate)
+	h := &codec.Header{
+		Service: serviceName,
+		Method:  methodName,
+		Meta:    OutgoingMetadata(ctx),
+	}
+	setTimeout(ctx, h)
+	cli.mu.Lock()
+	if cli.closed || cli.shutdown {
+		cli.mu.Unlock()
+		return nil, ErrClosed
+	}
+	st.seq = cli.seq
+	cli.seq++
+	cli.streams[st.seq] = st
+	cli.mu.Unlock()
+	h.SeqId = st.seq
+	if err := cli.send(h, args); err != nil {
+		cli.removeStream(st.seq)
+		return nil, errors.WithMessage(err, "send request fail")
+	}
+	// ctx结束时放弃该流
+	go func() {
+		select {
+		case <-ctx.Done():
+			st.abandon(errors.WithMessage(ctx.Err(), "stream fail"))
+		case <-st.end:
+		}
+	}()
+	return st, nil
+}
+
+// 将流移出streams，只有成功移出的一方可以结束该流
+func (cli *client) removeStream(seq uint64) *cliStream {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	st := cli.streams[seq]
+	delete(cli.streams, seq)
+	return st
+}
+
+// 结束流
+func (st *cliStream) finish(err error, trailer map[string]string) {
+	st.endOnce.Do(func() {
+		st.err = err
+		st.trailer = trailer
+		close(st.end)
+		st.recvq.close()
+	})
+}
+
+// 放弃流，并通知服务端取消
+func (st *cliStream) abandon(err error) {
+	if st.cli.removeStream(st.seq) == nil {
+		return
+	}
+	if e := st.cli.sendCancel(st.seq); e != nil {
+		ErrorLogger.Printf("Send cancel fail: %s\n", e)
+	}
+	st.finish(err, nil)
+}
+
+// 流结束之后返回出错的原因
+func (st *cliStream) endErr() error {
+	if st.err != nil {
+		return st.err
+	}
+	return ErrStreamClosed
+}
+
+// 向服务端发送一个消息
+func (st *cliStream) sendMsg(msg any) error {
+	if st.halfClosed.Load() {
+		return ErrStreamClosed
+	}
+	if !st.sendWindow.acquire(st.end) {
+		return st.endErr()
+	}
+	h := &codec.Header{
+		Service: st.service,
+		Method:  st.method,
+		SeqId:   st.seq,
+		Type:    codec.MsgStreamData,
+	}
+	return st.cli.send(h, msg)
+}
+
+// 告知服务端客户端已经发送完毕
+func (st *cliStream) closeSend() error {
+	if !st.halfClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+	select {
+	case <-st.end:
+		return st.endErr()
+	default:
+	}
+	h := &codec.Header{SeqId: st.seq, Type: codec.MsgStreamHalfClose}
+	return st.cli.send(h, invalidBody)
+}
+
+// 告知服务端可以继续发送n个消息
+func (st *cliStream) sendWindowUpdate(n uint32) {
+	select {
+	case <-st.end:
+		return
+	default:
+	}
+	h := &codec.Header{SeqId: st.seq, Type: codec.MsgWindowUpdate, Window: n}
+	if err := st.cli.send(h, invalidBody); err != nil {
+		ErrorLogger.Printf("Send window update fail: %s\n", err)
+	}
+}
+
+// receive中处理流上收到的消息
+func (st *cliStream) dispatch(h *codec.Header) error {
+	switch h.Type {
+	case codec.MsgStreamData:
+		msg := st.newMsg()
+		// 消息解码失败时放弃该流，连接上的其他调用不受影响
+		if err := st.cli.ReadBody(msg); err != nil {
+			st.abandon(errors.WithMessage(err, "stream read message fail"))
+			return nil
+		}
+		if !st.recvq.push(msg) {
+			st.abandon(errors.New("server exceeds stream flow control window"))
+		}
+		return nil
+	case codec.MsgWindowUpdate:
+		st.sendWindow.add(h.Window)
+		return st.cli.ReadBody(nil)
+	}
+	// 流结束，或者调用在开始之前就出错了
+	st.cli.removeStream(h.SeqId)
+	var err error
+	if h.Err != "" {
+		err = errorFromHeader(h)
+	}
+	var body any
+	if err == nil && st.reply != nil {
+		body = st.reply
+	}
+	if readErr := st.cli.ReadBody(body); err == nil && readErr != nil {
+		err = readErr
+	}
+	st.finish(err, h.Meta)
+	return nil
+}
+
+// 等待流结束
+func (st *cliStream) wait() error {
+	<-st.end
+	return st.err
+}
+
+// StreamReader 服务端流式调用在客户端的迭代器
+//
+//	for r.Next() {
+//		msg := r.Value()
+//	}
+//	if err := r.Err(); err != nil {}
+type StreamReader[R any] struct {
+	st  *cliStream
+	cur R
+}
+
+// Next 等待下一个消息，流结束或者出错时返回false
+func (r *StreamReader[R]) Next() bool {
+	msg, ok := r.st.recvq.pop(nil)
+	if !ok {
+		return false
+	}
+	r.cur = *msg.(*R)
+	return true
+}
+
+// Value 返回Next取到的消息
+func (r *StreamReader[R]) Value() R {
+	return r.cur
+}
+
+// Err 流结束之后返回出错的原因，正常结束时返回nil
+func (r *StreamReader[R]) Err() error {
+	select {
+	case <-r.st.end:
+		return r.st.err
+	default:
+		return nil
+	}
+}
+
+// Trailer 流结束之后返回服务端设置的trailer
+func (r *StreamReader[R]) Trailer() Metadata {
+	select {
+	case <-r.st.end:
+		return r.st.trailer
+	default:
+		return nil
+	}
+}
+
+// Close 提前结束流，并通知服务端取消
+func (r *StreamReader[R]) Close() error {
+	r.st.abandon(ErrStreamClosed)
+	return nil
+}
+
+// StreamWriter 客户端流式调用在客户端的写入端
+type StreamWriter[T, R any] struct {
+	st    *cliStream
+	reply *R
+}
+
+// Send 向服务端发送一个消息，服务端的接收窗口已满时阻塞
+func (w *StreamWriter[T, R]) Send(msg T) error {
+	return w.st.sendMsg(msg)
+}
+
+// CloseAndRecv 告知服务端发送完毕，并等待服务端的返回
+func (w *StreamWriter[T, R]) CloseAndRecv() (R, error) {
+	if err := w.st.closeSend(); err != nil {
+		return *w.reply, err
+	}
+	err := w.st.wait()
+	return *w.reply, err
+}
+
+// Trailer 流结束之后返回服务端设置的trailer
+func (w *StreamWriter[T, R]) Trailer() Metadata {
+	select {
+	case <-w.st.end:
+		return w.st.trailer
+	default:
+		return nil
+	}
+}
+
+// Close 提前结束流，并通知服务端取消
+func (w *StreamWriter[T, R]) Close() error {
+	w.st.abandon(ErrStreamClosed)
+	return nil
+}
+
+// StreamReadWriter 双向流式调用在客户端的读写端，读取方式与StreamReader相同
+type StreamReadWriter[T, R any] struct {
+	*StreamReader[R]
+}
+
+// Send 向服务端发送一个消息，服务端的接收窗口已满时阻塞
+func (rw *StreamReadWriter[T, R]) Send(msg T) error {
+	return rw.st.sendMsg(msg)
+}
+
+// CloseSend 告知服务端发送完毕，之后仍可以继续读取服务端的消息
+func (rw *StreamReadWriter[T, R]) CloseSend() error {
+	return rw.st.closeSend()
+}
+
+// 经过客户端拦截器选取服务实例并建立流
+func (cli *Client) openStream(ctx context.Context, serviceName, methodName string, kind streamKind, args any, newMsg func() any, reply any) (*cliStream, error) {
+	info := &CallInfo{
+		Service:        serviceName,
+		Method:         methodName,
+		IsServerStream: kind == serverStreaming || kind == bidiStreaming,
+		IsClientStream: kind == clientStreaming || kind == bidiStreaming,
+	}
+	var st *cliStream
+	invoker := chainCliInterceptors(cli.interceptors, info, func(ctx context.Context, args, _ any) error {
+		c, err := cli.d.get(serviceName, cli.selectMode)
+		if err != nil {
+			return err
+		}
+		info.Addr = c.targetAddr
+		// 客户端流式调用的请求不带参数，参数在之后的流消息中
+		if info.IsClientStream {
+			args = invalidBody
+		}
+		st, err = c.openStream(ctx, serviceName, methodName, args, newMsg, reply)
+		return err
+	})
+	if err := invoker(ctx, args, nil); err != nil {
+		return nil, err
+	}
+	if st == nil {
+		return nil, errors.New("interceptor returns without opening the stream")
+	}
+	return st, nil
+}
+
+// CallStream 发起一个服务端流式调用，返回用于依次读取消息的迭代器
+func CallStream[R any](ctx context.Context, cli *Client, serviceName, methodName string, args any) (*StreamReader[R], error) {
+	st, err := cli.openStream(ctx, serviceName, methodName, serverStreaming, args, func() any {
+		return new(R)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReader[R]{st: st}, nil
+}
+
+// OpenClientStream 发起一个客户端流式调用，T为发送的消息类型，R为服务端返回的类型
+func OpenClientStream[T, R any](ctx context.Context, cli *Client, serviceName, methodName string) (*StreamWriter[T, R], error) {
+	reply := new(R)
+	st, err := cli.openStream(ctx, serviceName, methodName, clientStreaming, nil, func() any {
+		return new(struct{})
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamWriter[T, R]{st: st, reply: reply}, nil
+}
+
+// OpenBidiStream 发起一个双向流式调用，T为发送的消息类型，R为接收的消息类型
+func OpenBidiStream[T, R any](ctx context.Context, cli *Client, serviceName, methodName string) (*StreamReadWriter[T, R], error) {
+	st, err := cli.openStream(ctx, serviceName, methodName, bidiStreaming, nil, func() any {
+		return new(R)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReadWriter[T, R]{StreamReader: &StreamReader[R]{st: st}}, nil
+}
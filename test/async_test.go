@@ -0,0 +1,85 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+)
+
+func TestGo(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	const n = 10
+	done := make(chan *toyrpc.Call, n)
+	for i := 0; i < n; i++ {
+		cli.Go(ctx, "Adder", "SlowAdd", Args{A: i, B: i}, new(int), done)
+	}
+	errCall := cli.Go(ctx, "ErrService", "GetErr", UserReq{}, new(UserResp), nil)
+
+	// 所有调用并发执行，总耗时应与单次调用接近
+	start := time.Now()
+	seen := make(map[int]bool)
+	for i := 0; i < n; i++ {
+		call := <-done
+		if call.Error != nil {
+			t.Fatal("Call fail:", call.Error)
+		}
+		args := call.Args.(Args)
+		if sum := *call.Reply.(*int); sum != args.A+args.B {
+			t.Fatalf("expect %d, got %d", args.A+args.B, sum)
+		}
+		seen[args.A] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("expect %d distinct replies, got %d", n, len(seen))
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("calls are not concurrent, elapsed %s", elapsed)
+	}
+	if call := <-errCall.Done; call != errCall || call.Error == nil {
+		t.Fatalf("expect error call, got %+v", call)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := cli.Notify(ctx, "Adder", "Record", Args{A: i}); err != nil {
+			t.Fatal("notify fail:", err)
+		}
+	}
+	// 单向调用在服务端并发执行，不保证顺序
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case args := <-notified:
+			seen[args.A] = true
+		case <-time.After(2 * time.Second):
+			t.Fatal("notification is not handled")
+		}
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expect 3 distinct notifications, got %v", seen)
+	}
+	// 出错的单向调用同样没有返回，之后的调用不受影响
+	if err := cli.Notify(ctx, "ErrService", "GetErr", UserReq{}); err != nil {
+		t.Fatal("notify fail:", err)
+	}
+	var sum int
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("expect 3, got %d, err: %v", sum, err)
+	}
+}
@@ -0,0 +1,283 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+	"github.com/2evl1u/toyrpc/codec"
+)
+
+type Payload struct {
+	Name    string            `msgpack:"name"`
+	Count   int64             `msgpack:"count,omitempty"`
+	Ratio   float64           `msgpack:"ratio"`
+	Tags    []string          `msgpack:"tags"`
+	Attrs   map[string]string `msgpack:"attrs"`
+	Raw     []byte            `msgpack:"raw"`
+	Next    *Payload          `msgpack:"next"`
+	Ignored int               `msgpack:"-"`
+}
+
+func TestMsgpack(t *testing.T) {
+	var mp codec.MsgpackEncDec
+	// 与其他语言的实现保持一致的编码结果
+	data, err := mp.Marshal(map[string]any{"a": 1})
+	if err != nil || !bytes.Equal(data, []byte{0x81, 0xa1, 'a', 0x01}) {
+		t.Fatalf("unexpected encoding: %x, err: %v", data, err)
+	}
+
+	in := Payload{
+		Name:    "toyrpc",
+		Ratio:   -1.5,
+		Tags:    []string{"a", "b"},
+		Attrs:   map[string]string{"k": "v"},
+		Raw:     []byte{0, 1, 2},
+		Next:    &Payload{Name: "next", Count: -70000},
+		Ignored: 1,
+	}
+	if data, err = mp.Marshal(in); err != nil {
+		t.Fatal(err)
+	}
+	var out Payload
+	if err = mp.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Ignored = 0
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("expect %+v, got %+v", in, out)
+	}
+	// 截断的数据应返回错误
+	if err = mp.Unmarshal(data[:len(data)-1], &out); err == nil {
+		t.Fatal("expect error for truncated data")
+	}
+}
+
+// Nested 可以无限嵌套的类型，用于测试嵌套层数的限制
+type Nested []Nested
+
+// 生成{"x": [[[...]]]}，prefix为map头以及key，open为只有一个元素的数组头，empty为空数组，嵌套depth层
+func deeplyNested(prefix []byte, open, empty byte, depth int) []byte {
+	data := append(append([]byte(nil), prefix...), bytes.Repeat([]byte{open}, depth)...)
+	return append(data, empty)
+}
+
+func TestMsgpackDepth(t *testing.T) {
+	var mp codec.MsgpackEncDec
+	data := deeplyNested([]byte{0x81, 0xa1, 'x'}, 0x91, 0x90, 1<<20)
+	// 帧头中不认识的字段会被跳过
+	var h codec.Header
+	if err := mp.Unmarshal(data, &h); err == nil || !strings.Contains(err.Error(), "nesting depth") {
+		t.Fatalf("expect nesting depth error, got %v", err)
+	}
+	var x any
+	if err := mp.Unmarshal(data, &x); err == nil || !strings.Contains(err.Error(), "nesting depth") {
+		t.Fatalf("expect nesting depth error, got %v", err)
+	}
+	var m map[string]Nested
+	if err := mp.Unmarshal(data, &m); err == nil || !strings.Contains(err.Error(), "nesting depth") {
+		t.Fatalf("expect nesting depth error, got %v", err)
+	}
+	// 不超过限制的嵌套正常解码
+	if err := mp.Unmarshal(deeplyNested([]byte{0x81, 0xa1, 'x'}, 0x91, 0x90, 100), &m); err != nil || len(m["x"]) != 1 {
+		t.Fatalf("expect nested value, got %v, err: %v", m, err)
+	}
+}
+
+func TestMsgpackCall(t *testing.T) {
+	_, svr, listener, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack := rawHandshake(t, conn, 1, codec.MsgpackType); ack[5] != 0 {
+		t.Fatalf("handshake rejected: %q", ack)
+	}
+	c := codec.NewMsgpackEncDec(conn)
+	defer c.Close()
+	if err = c.Write(&codec.Header{Service: "Adder", Method: "Add", SeqId: 1}, Args{A: 1, B: 2}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var h codec.Header
+	var sum int
+	if err = c.ReadHeader(&h); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ReadBody(&sum); err != nil || h.Err != "" || sum != 3 {
+		t.Fatalf("expect 3, got %d, header: %+v, err: %v", sum, h, err)
+	}
+}
+
+type Signed struct {
+	Zeta  int               `cbor:"z"`
+	Alpha string            `cbor:"a"`
+	Extra map[string]uint64 `cbor:"extra,omitempty"`
+	Skip  bool              `cbor:"-"`
+}
+
+func TestCBOR(t *testing.T) {
+	var cb codec.CBOREncDec
+	// RFC 8949 附录A中的例子以及deterministic encoding的要求
+	cases := []struct {
+		v    any
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{-1, []byte{0x20}},
+		{1000, []byte{0x19, 0x03, 0xe8}},
+		{1.5, []byte{0xf9, 0x3e, 0x00}},
+		{65504.0, []byte{0xf9, 0x7b, 0xff}},
+		{5.960464477539063e-8, []byte{0xf9, 0x00, 0x01}},
+		{100000.0, []byte{0xfa, 0x47, 0xc3, 0x50, 0x00}},
+		{1.1, []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+		{"a", []byte{0x61, 'a'}},
+		{map[string]int{"b": 1, "a": 2}, []byte{0xa2, 0x61, 'a', 0x02, 0x61, 'b', 0x01}},
+		{Signed{Zeta: 1, Alpha: "x", Skip: true}, []byte{0xa2, 0x61, 'a', 0x61, 'x', 0x61, 'z', 0x01}},
+	}
+	for _, c := range cases {
+		data, err := cb.Marshal(c.v)
+		if err != nil || !bytes.Equal(data, c.want) {
+			t.Fatalf("encode %v: expect %x, got %x, err: %v", c.v, c.want, data, err)
+		}
+	}
+
+	// 相同的值总是得到相同的字节
+	in := Signed{Zeta: -300, Alpha: "toyrpc", Extra: map[string]uint64{"x": 1, "yy": 2, "z": 3, "w": 1 << 40}}
+	first, err := cb.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		data, _ := cb.Marshal(in)
+		if !bytes.Equal(first, data) {
+			t.Fatalf("encoding is not deterministic: %x vs %x", first, data)
+		}
+	}
+	var out Signed
+	if err = cb.Unmarshal(first, &out); err != nil || !reflect.DeepEqual(in, out) {
+		t.Fatalf("expect %+v, got %+v, err: %v", in, out, err)
+	}
+}
+
+func TestCBORDepth(t *testing.T) {
+	var cb codec.CBOREncDec
+	data := deeplyNested([]byte{0xa1, 0x61, 'x'}, 0x81, 0x80, 1<<20)
+	// 帧头中不认识的字段会被跳过
+	var h codec.Header
+	if err := cb.Unmarshal(data, &h); err == nil || !strings.Contains(err.Error(), "nesting depth") {
+		t.Fatalf("expect nesting depth error, got %v", err)
+	}
+	var m map[string]Nested
+	if err := cb.Unmarshal(data, &m); err == nil || !strings.Contains(err.Error(), "nesting depth") {
+		t.Fatalf("expect nesting depth error, got %v", err)
+	}
+	if err := cb.Unmarshal(deeplyNested([]byte{0xa1, 0x61, 'x'}, 0x81, 0x80, 100), &m); err != nil || len(m["x"]) != 1 {
+		t.Fatalf("expect nested value, got %v, err: %v", m, err)
+	}
+}
+
+func TestCBORCall(t *testing.T) {
+	_, svr, listener, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack := rawHandshake(t, conn, 1, codec.CBORType); ack[5] != 0 {
+		t.Fatalf("handshake rejected: %q", ack)
+	}
+	c := codec.NewCBOREncDec(conn)
+	defer c.Close()
+	if err = c.Write(&codec.Header{Service: "Adder", Method: "Add", SeqId: 1}, Args{A: -1, B: 2}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var h codec.Header
+	var sum int
+	if err = c.ReadHeader(&h); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ReadBody(&sum); err != nil || h.Err != "" || sum != 1 {
+		t.Fatalf("expect 1, got %d, header: %+v, err: %v", sum, h, err)
+	}
+}
+
+func TestCodecRegistry(t *testing.T) {
+	const custom = "json-custom"
+	maker := func(conn io.ReadWriteCloser) codec.Codec {
+		return codec.NewFrameCodec(conn, codec.JSONEncDec{})
+	}
+	if err := codec.Register(custom, maker); err != nil {
+		t.Fatal("register fail:", err)
+	}
+	if err := codec.Register(custom, maker); err == nil {
+		t.Fatal("expect duplicate register error")
+	}
+	names := codec.List()
+	if i := sort.SearchStrings(names, custom); !sort.StringsAreSorted(names) || i == len(names) || names[i] != custom {
+		t.Fatalf("expect sorted list with %s, got %v", custom, names)
+	}
+
+	_, svr, listener, _ := startServer(t, toyrpc.WithSvrCodecs(custom, codec.GobType))
+	defer svr.Shutdown(context.Background())
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+	// 已注册但不被服务端允许的编码类型会被拒绝
+	if ack := rawHandshake(t, dial(), 1, codec.JSONType); ack[5] != 1 {
+		t.Fatalf("expect json rejected, got %q", ack)
+	}
+	if ack := rawHandshake(t, dial(), 1, codec.JSONType, custom); ack[5] != 0 || string(ack[7:7+ack[6]]) != custom {
+		t.Fatalf("expect %s accepted, got %q", custom, ack)
+	}
+
+	if err := codec.Unregister(custom); err != nil {
+		t.Fatal("unregister fail:", err)
+	}
+	if err := codec.Unregister(custom); err == nil {
+		t.Fatal("expect unregister missing codec error")
+	}
+	if ack := rawHandshake(t, dial(), 1, custom); ack[5] != 1 {
+		t.Fatalf("expect unregistered codec rejected, got %q", ack)
+	}
+}
+
+func TestClientCodecType(t *testing.T) {
+	registry, svr, _, _ := startServer(t, toyrpc.WithSvrCodecs(codec.MsgpackType))
+	defer svr.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mpCli := toyrpc.NewClient(registry.URL, toyrpc.WithCodecType(codec.MsgpackType))
+	defer mpCli.Close()
+	var sum int
+	if err := mpCli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("expect 3, got %d, err: %v", sum, err)
+	}
+	// 其他client仍然使用默认的编码类型，被只接受msgpack的服务端拒绝
+	if toyrpc.DefaultSettings.CodecType != codec.JSONType {
+		t.Fatalf("default settings are changed to %s", toyrpc.DefaultSettings.CodecType)
+	}
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); !errors.Is(err, toyrpc.ErrHandshakeRejected) {
+		t.Fatalf("expect ErrHandshakeRejected, got %v", err)
+	}
+}
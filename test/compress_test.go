@@ -0,0 +1,90 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+	"github.com/2evl1u/toyrpc/codec"
+)
+
+// 内存中的连接，写入的数据可以被依次读出
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (c *bufConn) Close() error {
+	return nil
+}
+
+func TestFrameCompression(t *testing.T) {
+	big := strings.Repeat("toyrpc", 1000)
+	raw := &bufConn{}
+	_ = codec.NewJSONEncDec(raw).Write(&codec.Header{SeqId: 1}, big)
+
+	comp, _ := codec.GetCompressor(codec.GzipCompressor)
+	conn := &bufConn{}
+	w := codec.NewFrameCodec(conn, codec.JSONEncDec{})
+	w.SetCompression(comp, 100)
+	// 小于阈值的body不压缩
+	if err := w.Write(&codec.Header{SeqId: 1}, "small"); err != nil {
+		t.Fatal(err)
+	}
+	if flags := conn.Bytes()[3]; flags != 0 {
+		t.Fatalf("expect small body uncompressed, got flags %#x", flags)
+	}
+	smallLen := conn.Len()
+	if err := w.Write(&codec.Header{SeqId: 2}, big); err != nil {
+		t.Fatal(err)
+	}
+	if n := conn.Len() - smallLen; n >= raw.Len()/10 {
+		t.Fatalf("expect compressed frame much smaller than %d bytes, got %d", raw.Len(), n)
+	}
+	data := conn.Bytes()
+
+	// 协商了压缩的一方可以解压
+	r := codec.NewFrameCodec(&bufConn{*bytes.NewBuffer(append([]byte(nil), data...))}, codec.JSONEncDec{})
+	r.SetCompression(comp, 100)
+	var h codec.Header
+	var s string
+	for _, want := range []string{"small", big} {
+		if err := r.ReadHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.ReadBody(&s); err != nil || s != want {
+			t.Fatalf("expect %d bytes, got %d bytes, err: %v", len(want), len(s), err)
+		}
+	}
+
+	// 没有协商压缩的一方无法处理压缩的帧
+	r2 := codec.NewJSONEncDec(&bufConn{*bytes.NewBuffer(data)})
+	if err := r2.ReadHeader(&h); err != nil || h.SeqId != 1 {
+		t.Fatalf("expect seq 1, got %+v, err: %v", h, err)
+	}
+	_ = r2.ReadBody(nil)
+	if err := r2.ReadHeader(&h); !errors.Is(err, codec.ErrUnknownFrame) {
+		t.Fatalf("expect ErrUnknownFrame, got %+v, err: %v", h, err)
+	}
+}
+
+func TestCompressedCall(t *testing.T) {
+	registry, svr, _, _ := startServer(t, toyrpc.WithSvrCompressThreshold(64))
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL, toyrpc.WithCompression(codec.GzipCompressor, 64))
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var reply string
+	if err := cli.Call(ctx, "Adder", "Repeat", Args{A: 10000}, &reply); err != nil || reply != strings.Repeat("toyrpc", 10000) {
+		t.Fatalf("expect repeated string, got %d bytes, err: %v", len(reply), err)
+	}
+	var sum int
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("expect 3, got %d, err: %v", sum, err)
+	}
+}
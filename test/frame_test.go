@@ -0,0 +1,76 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+	"github.com/2evl1u/toyrpc/codec"
+)
+
+func TestBadBody(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// 参数无法解码为Args，只有这一个调用失败
+	var sum int
+	if err := cli.Call(ctx, "Adder", "Add", "not args", &sum); toyrpc.Code(err) != toyrpc.CodeInvalidArgument {
+		t.Fatalf("expect InvalidArgument, got %v", err)
+	}
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("expect 3, got %d, err: %v", sum, err)
+	}
+	// 返回无法解码为reply，连接仍然可用
+	var wrong string
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &wrong); err == nil {
+		t.Fatal("expect decode reply error")
+	}
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 2, B: 2}, &sum); err != nil || sum != 4 {
+		t.Fatalf("expect 4, got %d, err: %v", sum, err)
+	}
+}
+
+func TestUnknownFrame(t *testing.T) {
+	_, svr, listener, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack := rawHandshake(t, conn, 1, "json"); ack[5] != 0 {
+		t.Fatalf("handshake rejected: %q", ack)
+	}
+	// 版本未知的帧无法处理，服务端返回错误并关闭连接，而不是让发送方一直等待
+	unknown := make([]byte, 12, 20)
+	binary.BigEndian.PutUint16(unknown[0:2], codec.FrameMagic)
+	unknown[2] = codec.FrameVersion + 1
+	binary.BigEndian.PutUint32(unknown[4:8], 3)
+	binary.BigEndian.PutUint32(unknown[8:12], 5)
+	unknown = append(unknown, "hdrbody!"...)
+	if _, err = conn.Write(unknown); err != nil {
+		t.Fatal(err)
+	}
+	c := codec.NewJSONEncDec(conn)
+	defer c.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var h codec.Header
+	if err = c.ReadHeader(&h); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(h.Err, codec.ErrUnknownFrame.Error()) {
+		t.Fatalf("expect unknown frame error, got %+v", h)
+	}
+	_ = c.ReadBody(nil)
+	if err = c.ReadHeader(&h); err == nil {
+		t.Fatalf("expect connection closed, got %+v", h)
+	}
+}
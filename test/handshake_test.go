@@ -0,0 +1,115 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+)
+
+// 手动发送hello并读取服务端的ack
+func rawHandshake(t *testing.T, conn net.Conn, version uint8, codecs ...string) []byte {
+	t.Helper()
+	var hello bytes.Buffer
+	_ = binary.Write(&hello, binary.BigEndian, uint32(toyrpc.MagicNumber))
+	hello.WriteByte(version)
+	hello.WriteByte(uint8(len(codecs)))
+	for _, c := range codecs {
+		hello.WriteByte(uint8(len(c)))
+		hello.WriteString(c)
+	}
+	hello.WriteByte(0) // 没有特性
+	if _, err := conn.Write(hello.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	// magic | version | status
+	ack := make([]byte, 6)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		t.Fatal(err)
+	}
+	rest := make([]byte, 256)
+	n, _ := conn.Read(rest)
+	return append(ack, rest[:n]...)
+}
+
+func TestHandshake(t *testing.T) {
+	_, svr, listener, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	t.Run("fallback codec", func(t *testing.T) {
+		ack := rawHandshake(t, dial(), toyrpc.HandshakeVersion+1, "unknown", "gob")
+		if ack[4] != toyrpc.HandshakeVersion || ack[5] != 0 || string(ack[7:7+ack[6]]) != "gob" {
+			t.Fatalf("expect version %d with gob, got %q", toyrpc.HandshakeVersion, ack)
+		}
+	})
+
+	t.Run("unsupported codec", func(t *testing.T) {
+		ack := rawHandshake(t, dial(), toyrpc.HandshakeVersion, "unknown")
+		if ack[5] != 1 || !strings.Contains(string(ack), "unsupported codecs") {
+			t.Fatalf("expect rejection, got %q", ack)
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		ack := rawHandshake(t, dial(), 0, "json")
+		if ack[5] != 1 || !strings.Contains(string(ack), "unsupported protocol version") {
+			t.Fatalf("expect rejection, got %q", ack)
+		}
+	})
+}
+
+// 服务端在ack中选择了客户端没有提供的编码类型或特性，客户端应拒绝该连接
+func TestHandshakeUnofferedAck(t *testing.T) {
+	for name, tail := range map[string][]byte{
+		"codec":   append([]byte{7}, append([]byte("msgpack"), 0)...),
+		"feature": append([]byte{3}, append([]byte("gob"), append([]byte{1, 13}, "compress/gzip"...)...)...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, _ = conn.Read(make([]byte, 256))
+				var ack bytes.Buffer
+				_ = binary.Write(&ack, binary.BigEndian, uint32(toyrpc.MagicNumber))
+				ack.Write([]byte{toyrpc.HandshakeVersion, 0})
+				ack.Write(tail)
+				_, _ = conn.Write(ack.Bytes())
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+			cli := toyrpc.NewClient("", toyrpc.WithServerAddrs(listener.Addr().String()))
+			defer cli.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			var sum int
+			if err = cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); !errors.Is(err, toyrpc.ErrHandshakeRejected) {
+				t.Fatalf("expect ErrHandshakeRejected, got %v", err)
+			}
+		})
+	}
+}
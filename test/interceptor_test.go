@@ -0,0 +1,176 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+)
+
+func TestSvrInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	record := func(name string) toyrpc.SvrInterceptor {
+		return func(ctx context.Context, info *toyrpc.MethodInfo, args, reply any, next toyrpc.Handler) error {
+			mu.Lock()
+			trace = append(trace, name+" before "+info.Service+"."+info.Method)
+			mu.Unlock()
+			err := next(ctx, args, reply)
+			mu.Lock()
+			trace = append(trace, name+" after")
+			mu.Unlock()
+			return err
+		}
+	}
+	// 拒绝调用ErrService的拦截器
+	deny := func(ctx context.Context, info *toyrpc.MethodInfo, args, reply any, next toyrpc.Handler) error {
+		if info.Service == "ErrService" {
+			return errors.New("permission denied")
+		}
+		return next(ctx, args, reply)
+	}
+	registry, svr, _, _ := startServer(t, toyrpc.WithSvrInterceptors(record("first"), record("second"), deny))
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sum int
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("expect 3, got %d, err: %v", sum, err)
+	}
+	mu.Lock()
+	got := strings.Join(trace, ",")
+	mu.Unlock()
+	if want := "first before Adder.Add,second before Adder.Add,second after,first after"; got != want {
+		t.Fatalf("unexpected interceptor order: %s", got)
+	}
+
+	var ret UserResp
+	err := cli.Call(ctx, "ErrService", "GetErr", UserReq{}, &ret)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expect permission denied, got %v", err)
+	}
+}
+
+func TestCliInterceptors(t *testing.T) {
+	registry, svr, listener, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+
+	var infos []toyrpc.CallInfo
+	var results []error
+	observe := func(ctx context.Context, info *toyrpc.CallInfo, args, reply any, invoker toyrpc.Invoker) error {
+		err := invoker(ctx, args, reply)
+		infos = append(infos, *info)
+		results = append(results, err)
+		return err
+	}
+	// 故障注入：对Add的调用直接返回错误，不发送请求
+	errInjected := errors.New("injected fault")
+	inject := func(ctx context.Context, info *toyrpc.CallInfo, args, reply any, invoker toyrpc.Invoker) error {
+		if info.Method == "Add" && args.(Args).A < 0 {
+			return errInjected
+		}
+		return invoker(ctx, args, reply)
+	}
+	cli := toyrpc.NewClient(registry.URL, toyrpc.WithInterceptors(observe, inject))
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sum int
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("expect 3, got %d, err: %v", sum, err)
+	}
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: -1, B: 2}, &sum); !errors.Is(err, errInjected) {
+		t.Fatalf("expect injected fault, got %v", err)
+	}
+	// 找不到服务实例的失败同样经过拦截器
+	if err := cli.Call(ctx, "Missing", "Add", Args{}, &sum); err == nil {
+		t.Fatal("expect no available servers error")
+	}
+	if len(infos) != 3 {
+		t.Fatalf("expect 3 observed calls, got %d", len(infos))
+	}
+	if infos[0].Service != "Adder" || infos[0].Method != "Add" || infos[0].Addr != listener.Addr().String() {
+		t.Fatalf("unexpected call info: %+v", infos[0])
+	}
+	if infos[2].Service != "Missing" || infos[2].Addr != "" {
+		t.Fatalf("unexpected call info: %+v", infos[2])
+	}
+	if results[0] != nil || !errors.Is(results[1], errInjected) || !strings.Contains(results[2].Error(), "no available servers") {
+		t.Fatalf("unexpected results: %v", results)
+	}
+}
+
+func TestCliInterceptorsOnStreams(t *testing.T) {
+	// 服务端拦截器记录流式调用收到的元数据
+	received := make(chan string, 3)
+	record := func(ctx context.Context, info *toyrpc.MethodInfo, args, reply any, next toyrpc.Handler) error {
+		received <- toyrpc.IncomingMetadata(ctx).Get("request-id")
+		return next(ctx, args, reply)
+	}
+	registry, svr, _, _ := startServer(t, toyrpc.WithSvrInterceptors(record))
+	defer svr.Shutdown(context.Background())
+	if err := svr.AsService(&Feed{}); err != nil {
+		t.Fatal(err)
+	}
+	waitRegistered(t, registry.URL, "Feed", true)
+
+	var infos []toyrpc.CallInfo
+	inject := func(ctx context.Context, info *toyrpc.CallInfo, args, reply any, invoker toyrpc.Invoker) error {
+		infos = append(infos, *info)
+		if info.Method == "Missing" {
+			return errors.New("rejected by interceptor")
+		}
+		return invoker(toyrpc.WithOutgoingMetadata(ctx, toyrpc.Metadata{"request-id": info.Method}), args, reply)
+	}
+	cli := toyrpc.NewClient(registry.URL, toyrpc.WithInterceptors(inject))
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := toyrpc.CallStream[Item](ctx, cli, "Feed", "Count", Args{A: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+	}
+	w, err := toyrpc.OpenClientStream[Item, int](ctx, cli, "Feed", "Sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+	rw, err := toyrpc.OpenBidiStream[Item, Item](ctx, cli, "Feed", "Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rw.CloseSend()
+	for rw.Next() {
+	}
+	if _, err = toyrpc.OpenBidiStream[Item, Item](ctx, cli, "Feed", "Missing"); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expect rejected by interceptor, got %v", err)
+	}
+
+	for _, method := range []string{"Count", "Sum", "Echo"} {
+		if got := <-received; got != method {
+			t.Fatalf("expect metadata %s, got %s", method, got)
+		}
+	}
+	want := [][2]bool{{true, false}, {false, true}, {true, true}, {true, true}}
+	if len(infos) != len(want) {
+		t.Fatalf("expect %d observed streams, got %d", len(want), len(infos))
+	}
+	for i, info := range infos {
+		if info.IsServerStream != want[i][0] || info.IsClientStream != want[i][1] {
+			t.Fatalf("unexpected stream flags of %s: %+v", info.Method, info)
+		}
+	}
+}
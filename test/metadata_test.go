@@ -0,0 +1,47 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+)
+
+func TestMetadata(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	if err := svr.AsService(&MetaService{}); err != nil {
+		t.Fatal(err)
+	}
+	waitRegistered(t, registry.URL, "MetaService", true)
+	// 通过客户端拦截器注入元数据
+	inject := func(ctx context.Context, info *toyrpc.CallInfo, args, reply any, invoker toyrpc.Invoker) error {
+		return invoker(toyrpc.WithOutgoingMetadata(ctx, toyrpc.Metadata{"request-id": "req-1"}), args, reply)
+	}
+	cli := toyrpc.NewClient(registry.URL, toyrpc.WithInterceptors(inject))
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = toyrpc.WithOutgoingMetadata(ctx, toyrpc.Metadata{"tenant": "t-42"})
+	var trailer toyrpc.Metadata
+	ctx = toyrpc.WithTrailer(ctx, &trailer)
+
+	var value string
+	if err := cli.Call(ctx, "MetaService", "Echo", "tenant", &value); err != nil {
+		t.Fatal("Call fail:", err)
+	}
+	if value != "t-42" {
+		t.Fatalf("expect tenant t-42, got %q", value)
+	}
+	if trailer.Get("served-by") != "MetaService" {
+		t.Fatalf("unexpected trailer: %v", trailer)
+	}
+	if err := cli.Call(ctx, "MetaService", "Echo", "request-id", &value); err != nil {
+		t.Fatal("Call fail:", err)
+	}
+	if value != "req-1" {
+		t.Fatalf("expect request-id req-1, got %q", value)
+	}
+}
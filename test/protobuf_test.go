@@ -0,0 +1,71 @@
+package test
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+	"github.com/2evl1u/toyrpc/codec"
+)
+
+func TestProtobufCodec(t *testing.T) {
+	// protobuf编解码器在codec包初始化时注册
+	names := codec.List()
+	if i := sort.SearchStrings(names, codec.ProtobufType); i == len(names) || names[i] != codec.ProtobufType {
+		t.Fatalf("expect %s registered, got %v", codec.ProtobufType, names)
+	}
+	registry, svr, listener, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	if err := svr.AsService(&PBAdder{}); err != nil {
+		t.Fatal(err)
+	}
+	waitRegistered(t, registry.URL, "PBAdder", true)
+
+	// 没有实现Marshal的类型应明确报错
+	if _, err := (codec.ProtobufEncDec{}).Marshal(Args{}); err == nil || !strings.Contains(err.Error(), "does not implement") {
+		t.Fatalf("expect not implement error, got %v", err)
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack := rawHandshake(t, conn, 1, codec.ProtobufType); ack[5] != 0 {
+		t.Fatalf("handshake rejected: %q", ack)
+	}
+	maker, err := codec.Get(codec.ProtobufType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := maker(conn)
+	defer c.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	h := &codec.Header{Service: "PBAdder", Method: "Add", SeqId: 1, Meta: map[string]string{"k": "v"}}
+	if err = c.Write(h, &PBArgs{A: 1, B: 300}); err != nil {
+		t.Fatal(err)
+	}
+	var sum PBSum
+	if err = c.ReadHeader(h); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ReadBody(&sum); err != nil || h.SeqId != 1 || h.Err != "" || sum.Sum != 301 {
+		t.Fatalf("expect 301, got %d, header: %+v, err: %v", sum.Sum, h, err)
+	}
+
+	// 服务端的参数类型没有实现Unmarshal，返回InvalidArgument
+	if err = c.Write(&codec.Header{Service: "Adder", Method: "Add", SeqId: 2}, &PBArgs{A: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ReadHeader(h); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.ReadBody(nil)
+	if h.SeqId != 2 || toyrpc.StatusCode(h.Code) != toyrpc.CodeInvalidArgument || !strings.Contains(h.Err, "does not implement") {
+		t.Fatalf("expect InvalidArgument, got %+v", h)
+	}
+}
@@ -0,0 +1,386 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+	"github.com/2evl1u/toyrpc/codec"
+)
+
+// 启动一个注册中心以及一个监听在随机端口上的服务器
+func startServer(t *testing.T, opts ...toyrpc.SvrOption) (*httptest.Server, *toyrpc.Server, net.Listener, chan error) {
+	t.Helper()
+	registry := httptest.NewServer(toyrpc.NewRegistry())
+	t.Cleanup(registry.Close)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := toyrpc.NewServer(registry.URL, opts...)
+	if err = svr.AsService(&Adder{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = svr.AsService(&ErrService{}); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- svr.Serve(listener)
+	}()
+	// 等待服务器向注册中心注册完成
+	waitRegistered(t, registry.URL, "Adder", true)
+	waitRegistered(t, registry.URL, "ErrService", true)
+	return registry, svr, listener, served
+}
+
+func waitRegistered(t *testing.T, registry, serviceName string, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(registry + toyrpc.DefaultRegisterPath + "?serviceName=" + serviceName)
+		if err == nil {
+			var addrs []string
+			_ = json.NewDecoder(resp.Body).Decode(&addrs)
+			_ = resp.Body.Close()
+			if (len(addrs) > 0) == want {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("service %s registered state is not %v", serviceName, want)
+}
+
+func TestServeOnListener(t *testing.T) {
+	registry, svr, _, served := startServer(t)
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	var sum int
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 3, B: 5}, &sum); err != nil {
+		t.Fatal("Call fail:", err)
+	}
+	if sum != 8 {
+		t.Fatalf("expect 8, got %d", sum)
+	}
+	if err := svr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; !errors.Is(err, toyrpc.ErrServerClosed) {
+		t.Fatalf("expect ErrServerClosed, got %v", err)
+	}
+}
+
+func TestContextMethod(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	var sum int
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cli.Call(ctx, "Adder", "AddWithCtx", Args{A: 4, B: 6}, &sum); err != nil {
+		t.Fatal("Call fail:", err)
+	}
+	if sum != 10 {
+		t.Fatalf("expect 10, got %d", sum)
+	}
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	var ok bool
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := cli.Call(ctx, "Adder", "WaitCtx", Args{}, &ok); err == nil {
+		t.Fatal("expect timeout error")
+	}
+	// 服务端的context也应该在截止时间到达时结束
+	select {
+	case err := <-ctxErrs:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expect server context deadline exceeded, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server context is not cancelled")
+	}
+
+	// 已经超时的调用会被服务端直接拒绝
+	ctx2, cancel2 := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel2()
+	var sum int
+	if err := cli.Call(ctx2, "Adder", "Add", Args{A: 1, B: 1}, &sum); err == nil {
+		t.Fatal("expect expired error")
+	}
+	// 连接仍然可用
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel3()
+	if err := cli.Call(ctx3, "Adder", "Add", Args{A: 1, B: 1}, &sum); err != nil || sum != 2 {
+		t.Fatalf("expect 2, got %d, err: %v", sum, err)
+	}
+}
+
+// 超时时间以时长传递，服务端从收到请求时开始计时，不受双方时钟差异的影响
+func TestTimeoutIsRelative(t *testing.T) {
+	_, svr, listener, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack := rawHandshake(t, conn, 1, codec.JSONType); ack[5] != 0 {
+		t.Fatalf("handshake rejected: %q", ack)
+	}
+	c := codec.NewJSONEncDec(conn)
+	defer c.Close()
+	// 一小时作为绝对时间是1970年，只有按相对时长解释时调用才不会立即超时
+	h := &codec.Header{Service: "Adder", Method: "Remaining", SeqId: 1, Timeout: int64(time.Hour)}
+	if err = c.Write(h, Args{}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var rh codec.Header
+	var remaining int64
+	if err = c.ReadHeader(&rh); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ReadBody(&remaining); err != nil || rh.Err != "" {
+		t.Fatalf("call fail: %+v, err: %v", rh, err)
+	}
+	// 服务方法看到的剩余时间应接近客户端给出的时长
+	if d := time.Duration(remaining); d > time.Hour || d < time.Hour-time.Minute {
+		t.Fatalf("expect about 1h remaining, got %s", d)
+	}
+}
+
+// 超时的调用返回DeadlineExceeded，关闭服务器时仍要等待超时后还在执行的方法返回
+func TestTimeoutHoldsDrain(t *testing.T) {
+	_, svr, listener, served := startServer(t)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack := rawHandshake(t, conn, 1, codec.JSONType); ack[5] != 0 {
+		t.Fatalf("handshake rejected: %q", ack)
+	}
+	c := codec.NewJSONEncDec(conn)
+	defer c.Close()
+	start := time.Now()
+	h := &codec.Header{Service: "Adder", Method: "SlowAdd", SeqId: 1, Timeout: int64(50 * time.Millisecond)}
+	if err = c.Write(h, Args{A: 1, B: 2}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var rh codec.Header
+	if err = c.ReadHeader(&rh); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.ReadBody(nil)
+	if toyrpc.StatusCode(rh.Code) != toyrpc.CodeDeadlineExceeded {
+		t.Fatalf("expect DeadlineExceeded, got %+v", rh)
+	}
+	if err = svr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("shutdown returns after %s, before SlowAdd returns", elapsed)
+	}
+	<-served
+}
+
+func TestCancelCall(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	var ok bool
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := cli.Call(ctx, "Adder", "WaitCtx", Args{}, &ok); err == nil {
+		t.Fatal("expect cancel error")
+	}
+	// 客户端取消之后，服务端的context也应该被取消
+	select {
+	case err := <-ctxErrs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expect server context canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server context is not cancelled")
+	}
+	var sum int
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	if err := cli.Call(ctx2, "Adder", "Add", Args{A: 2, B: 2}, &sum); err != nil || sum != 4 {
+		t.Fatalf("expect 4, got %d, err: %v", sum, err)
+	}
+}
+
+func TestPanicRecover(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var ret int
+	err := cli.Call(ctx, "ErrService", "Panic", Args{A: 1}, &ret)
+	if !errors.Is(err, toyrpc.ErrPanic) {
+		t.Fatalf("expect ErrPanic, got %v", err)
+	}
+	// 普通错误不应该被识别为panic
+	var resp UserResp
+	if err = cli.Call(ctx, "ErrService", "GetErr", UserReq{}, &resp); err == nil || errors.Is(err, toyrpc.ErrPanic) {
+		t.Fatalf("expect plain error, got %v", err)
+	}
+	// 服务器和连接仍然可用
+	var sum int
+	if err = cli.Call(ctx, "Adder", "Add", Args{A: 2, B: 3}, &sum); err != nil || sum != 5 {
+		t.Fatalf("expect 5, got %d, err: %v", sum, err)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	registry, svr, listener, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	// 在注册中心登记一个服务器上并不存在的服务
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	body := strings.NewReader(`{"serviceName":"Ghost","serviceAddr":":` + port + `"}`)
+	resp, err := http.Post(registry.URL+toyrpc.DefaultRegisterPath, "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sum int
+	if err = cli.Call(ctx, "Ghost", "Add", Args{A: 2, B: 1}, &sum); !errors.Is(err, toyrpc.ErrServiceNotFound) {
+		t.Fatalf("expect ErrServiceNotFound, got %v", err)
+	}
+	if err = cli.Call(ctx, "Adder", "Sub", Args{A: 2, B: 1}, &sum); !errors.Is(err, toyrpc.ErrMethodNotFound) {
+		t.Fatalf("expect ErrMethodNotFound, got %v", err)
+	}
+	// 连接仍然可用
+	if err = cli.Call(ctx, "Adder", "Add", Args{A: 2, B: 1}, &sum); err != nil || sum != 3 {
+		t.Fatalf("expect 3, got %d, err: %v", sum, err)
+	}
+}
+
+func TestStartListenFail(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	svr := toyrpc.NewServer("http://localhost:9999", toyrpc.WithSvrAddress("127.0.0.1:"+strconv.Itoa(port)))
+	if err = svr.Start(); err == nil {
+		t.Fatal("expect listen error")
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	registry, svr, _, served := startServer(t)
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	callErr := make(chan error, 1)
+	var sum int
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		callErr <- cli.Call(ctx, "Adder", "SlowAdd", Args{A: 1, B: 2}, &sum)
+	}()
+	// 等待调用到达服务器
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- svr.Shutdown(ctx)
+	}()
+	// 正在关闭的服务器拒绝新的调用，客户端可以用errors.Is识别
+	time.Sleep(50 * time.Millisecond)
+	var ret int
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &ret); !errors.Is(err, toyrpc.ErrServerClosed) {
+		t.Fatalf("expect ErrServerClosed, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal("Shutdown fail:", err)
+	}
+	if err := <-callErr; err != nil {
+		t.Fatal("in-flight call fail:", err)
+	}
+	if sum != 3 {
+		t.Fatalf("expect 3, got %d", sum)
+	}
+	if err := <-served; !errors.Is(err, toyrpc.ErrServerClosed) {
+		t.Fatalf("expect ErrServerClosed, got %v", err)
+	}
+	waitRegistered(t, registry.URL, "Adder", false)
+}
+
+// 注册中心在注销时无响应，Shutdown也应在ctx到期后返回
+func TestShutdownHungRegistry(t *testing.T) {
+	hang := make(chan struct{})
+	reg := toyrpc.NewRegistry()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			select {
+			case <-hang:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer registry.Close()
+	defer close(hang)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := toyrpc.NewServer(registry.URL)
+	if err = svr.AsService(&Adder{}); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- svr.Serve(listener)
+	}()
+	waitRegistered(t, registry.URL, "Adder", true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- svr.Shutdown(ctx)
+	}()
+	select {
+	case <-shutdown:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown is blocked by the registry")
+	}
+	<-served
+}
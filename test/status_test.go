@@ -0,0 +1,47 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+)
+
+func TestStatus(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var ret int
+	err := cli.Call(ctx, "ErrService", "Validate", Args{A: -1}, &ret)
+	if code := toyrpc.Code(err); code != toyrpc.CodeInvalidArgument {
+		t.Fatalf("expect InvalidArgument, got %s", code)
+	}
+	s, ok := toyrpc.FromError(err)
+	if !ok {
+		t.Fatalf("expect Status, got %T", err)
+	}
+	if s.Message != "A must not be negative" || s.Details["field"] != "A" {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+
+	var resp UserResp
+	err = cli.Call(ctx, "ErrService", "GetErr", UserReq{}, &resp)
+	if code := toyrpc.Code(err); code != toyrpc.CodeUnknown {
+		t.Fatalf("expect Unknown, got %s", code)
+	}
+
+	expired, cancel2 := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel2()
+	time.Sleep(10 * time.Millisecond)
+	if code := toyrpc.Code(cli.Call(expired, "Adder", "Add", Args{}, &ret)); code != toyrpc.CodeDeadlineExceeded {
+		t.Fatalf("expect DeadlineExceeded, got %s", code)
+	}
+	if code := toyrpc.Code(cli.Call(ctx, "ErrService", "Validate", Args{A: 1}, &ret)); code != toyrpc.CodeOK || ret != 1 {
+		t.Fatalf("expect OK and 1, got %s and %d", code, ret)
+	}
+}
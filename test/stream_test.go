@@ -0,0 +1,193 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+)
+
+func TestServerStream(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	if err := svr.AsService(&Feed{}); err != nil {
+		t.Fatal(err)
+	}
+	waitRegistered(t, registry.URL, "Feed", true)
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("success", func(t *testing.T) {
+		r, err := toyrpc.CallStream[Item](ctx, cli, "Feed", "Count", Args{A: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for r.Next() {
+			if item := r.Value(); item.Index != n {
+				t.Fatalf("expect index %d, got %d", n, item.Index)
+			}
+			n++
+		}
+		if err = r.Err(); err != nil {
+			t.Fatal("stream fail:", err)
+		}
+		if n != 100 {
+			t.Fatalf("expect 100 items, got %d", n)
+		}
+		if r.Trailer().Get("count") != "100" {
+			t.Fatalf("unexpected trailer: %v", r.Trailer())
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		r, err := toyrpc.CallStream[Item](ctx, cli, "Feed", "Count", Args{A: 3, B: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for r.Next() {
+			n++
+		}
+		if n != 3 || toyrpc.Code(r.Err()) != toyrpc.CodeInternal {
+			t.Fatalf("expect 3 items and Internal, got %d and %v", n, r.Err())
+		}
+	})
+
+	t.Run("method not found", func(t *testing.T) {
+		r, err := toyrpc.CallStream[Item](ctx, cli, "Feed", "Missing", Args{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Next() || !errors.Is(r.Err(), toyrpc.ErrMethodNotFound) {
+			t.Fatalf("expect ErrMethodNotFound, got %v", r.Err())
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		r, err := toyrpc.CallStream[*Item](ctx, cli, "Feed", "Endless", Args{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5 && r.Next(); i++ {
+		}
+		_ = r.Close()
+		select {
+		case err = <-ctxErrs:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expect server context canceled, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("server stream is not cancelled")
+		}
+		// 连接仍然可用
+		var sum int
+		if err = cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 1}, &sum); err != nil || sum != 2 {
+			t.Fatalf("expect 2, got %d, err: %v", sum, err)
+		}
+	})
+}
+
+func TestClientAndBidiStream(t *testing.T) {
+	registry, svr, _, _ := startServer(t)
+	defer svr.Shutdown(context.Background())
+	if err := svr.AsService(&Feed{}); err != nil {
+		t.Fatal(err)
+	}
+	waitRegistered(t, registry.URL, "Feed", true)
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("client stream", func(t *testing.T) {
+		w, err := toyrpc.OpenClientStream[Item, int](ctx, cli, "Feed", "Sum")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 超过流量控制窗口的消息数量，发送方需要等待窗口更新
+		want := 0
+		for i := 0; i < 100; i++ {
+			if err = w.Send(Item{Index: i}); err != nil {
+				t.Fatal("send fail:", err)
+			}
+			want += i
+		}
+		sum, err := w.CloseAndRecv()
+		if err != nil || sum != want {
+			t.Fatalf("expect %d, got %d, err: %v", want, sum, err)
+		}
+	})
+
+	t.Run("bad message", func(t *testing.T) {
+		// 服务端无法解码的消息应以InvalidArgument结束流
+		w, err := toyrpc.OpenClientStream[string, int](ctx, cli, "Feed", "Sum")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = w.Send("not an item")
+		if _, err = w.CloseAndRecv(); toyrpc.Code(err) != toyrpc.CodeInvalidArgument {
+			t.Fatalf("expect InvalidArgument, got %v", err)
+		}
+	})
+
+	t.Run("send after cancel", func(t *testing.T) {
+		// 流结束之后即使还有发送额度也不能再发送
+		sctx, scancel := context.WithCancel(ctx)
+		w, err := toyrpc.OpenClientStream[Item, int](sctx, cli, "Feed", "Sum")
+		if err != nil {
+			t.Fatal(err)
+		}
+		scancel()
+		time.Sleep(50 * time.Millisecond)
+		if err = w.Send(Item{}); err == nil {
+			t.Fatal("expect send on canceled stream to fail")
+		}
+	})
+
+	t.Run("bidi stream", func(t *testing.T) {
+		rw, err := toyrpc.OpenBidiStream[Item, Item](ctx, cli, "Feed", "Echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err = rw.Send(Item{Index: i}); err != nil {
+				t.Fatal("send fail:", err)
+			}
+			if !rw.Next() || rw.Value().Index != i {
+				t.Fatalf("expect echo %d, got %v, err: %v", i, rw.Value(), rw.Err())
+			}
+		}
+		if err = rw.CloseSend(); err != nil {
+			t.Fatal(err)
+		}
+		if rw.Next() || rw.Err() != nil {
+			t.Fatalf("expect stream end, got %v", rw.Err())
+		}
+	})
+
+	t.Run("slow consumer", func(t *testing.T) {
+		r, err := toyrpc.CallStream[Item](ctx, cli, "Feed", "Count", Args{A: 200})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 不读取流时，服务端受窗口限制暂停发送，连接上的其他调用不受影响
+		var sum int
+		if err = cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+			t.Fatalf("expect 3, got %d, err: %v", sum, err)
+		}
+		n := 0
+		for r.Next() {
+			n++
+		}
+		if n != 200 || r.Err() != nil {
+			t.Fatalf("expect 200 items, got %d, err: %v", n, r.Err())
+		}
+	})
+}
@@ -1,8 +1,14 @@
 package test
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 
+	"github.com/2evl1u/toyrpc"
 	"github.com/pkg/errors"
 )
 
@@ -17,6 +23,65 @@ func (a *Adder) Add(args Args, sum *int) error {
 	return nil
 }
 
+// SlowAdd 模拟一个耗时的调用
+func (a *Adder) SlowAdd(args Args, sum *int) error {
+	time.Sleep(300 * time.Millisecond)
+	*sum = args.A + args.B
+	return nil
+}
+
+// AddWithCtx 带有context入参的方法
+func (a *Adder) AddWithCtx(ctx context.Context, args Args, sum *int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	*sum = args.A + args.B
+	return nil
+}
+
+// Remaining 返回服务端context距离截止时间的剩余时长，没有截止时间时返回-1
+func (a *Adder) Remaining(ctx context.Context, args Args, remaining *int64) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		*remaining = -1
+		return nil
+	}
+	*remaining = int64(time.Until(deadline))
+	return nil
+}
+
+// ctxErrs 记录WaitCtx结束时context的错误
+var ctxErrs = make(chan error, 1)
+
+// WaitCtx 一直等待直到context结束
+func (a *Adder) WaitCtx(ctx context.Context, args Args, ok *bool) error {
+	select {
+	case <-ctx.Done():
+		ctxErrs <- ctx.Err()
+		return ctx.Err()
+	case <-time.After(5 * time.Second):
+		ctxErrs <- nil
+		*ok = true
+		return nil
+	}
+}
+
+// Repeat 返回重复A次的字符串，用于产生较大的返回
+func (a *Adder) Repeat(args Args, reply *string) error {
+	*reply = strings.Repeat("toyrpc", args.A)
+	return nil
+}
+
+// notified 记录Record收到的通知
+var notified = make(chan Args, 10)
+
+// Record 记录收到的参数，用于测试单向调用
+func (a *Adder) Record(args Args, sum *int) error {
+	notified <- args
+	*sum = args.A + args.B
+	return nil
+}
+
 type UserReq struct {
 	UserId   int
 	UserName string
@@ -48,3 +113,161 @@ type ErrService struct{}
 func (e *ErrService) GetErr(userInfo UserReq, ret *UserResp) error {
 	return errors.New("a unexpected error")
 }
+
+type MetaService struct{}
+
+// Echo 返回客户端元数据中key对应的值，并设置trailer
+func (m *MetaService) Echo(ctx context.Context, key string, value *string) error {
+	*value = toyrpc.IncomingMetadata(ctx).Get(key)
+	return toyrpc.SetTrailer(ctx, toyrpc.Metadata{"served-by": "MetaService"})
+}
+
+// Whoami 返回调用方证书中的身份
+func (m *MetaService) Whoami(ctx context.Context, _ string, identity *string) error {
+	p, ok := toyrpc.PeerFromContext(ctx)
+	if !ok {
+		return toyrpc.NewStatus(toyrpc.CodeUnauthenticated, "no peer")
+	}
+	if *identity = p.Identity(); *identity == "" {
+		return toyrpc.NewStatus(toyrpc.CodeUnauthenticated, "no verified client certificate")
+	}
+	return nil
+}
+
+// Panic 模拟一个会panic的服务方法
+func (e *ErrService) Panic(args Args, ret *int) error {
+	var m map[string]int
+	m["boom"] = args.A
+	return nil
+}
+
+// Validate 参数不合法时返回带有详情的Status
+func (e *ErrService) Validate(args Args, ret *int) error {
+	if args.A < 0 {
+		return toyrpc.NewStatus(toyrpc.CodeInvalidArgument, "A must not be negative").
+			WithDetails(map[string]string{"field": "A"})
+	}
+	*ret = args.A
+	return nil
+}
+
+type Item struct {
+	Index int
+	Name  string
+}
+
+type Feed struct{}
+
+// Count 依次发送Count个Item
+func (f *Feed) Count(args Args, stream toyrpc.ServerStream[Item]) error {
+	for i := 0; i < args.A; i++ {
+		if err := stream.Send(Item{Index: i, Name: fmt.Sprintf("item-%d", i)}); err != nil {
+			return err
+		}
+	}
+	// 发送B个之后出错
+	if args.B > 0 {
+		return toyrpc.NewStatus(toyrpc.CodeInternal, "feed broken")
+	}
+	return toyrpc.SetTrailer(stream.Context(), toyrpc.Metadata{"count": fmt.Sprint(args.A)})
+}
+
+// Endless 一直发送，直到客户端取消
+func (f *Feed) Endless(args Args, stream toyrpc.ServerStream[*Item]) error {
+	for i := 0; ; i++ {
+		if err := stream.Send(&Item{Index: i}); err != nil {
+			ctxErrs <- stream.Context().Err()
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Sum 累加客户端发送的所有Item的Index
+func (f *Feed) Sum(stream toyrpc.ClientStream[Item], reply *int) error {
+	for {
+		item, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		*reply += item.Index
+	}
+}
+
+// Echo 将客户端发送的Item原样返回
+func (f *Feed) Echo(stream toyrpc.BidiStream[Item, Item]) error {
+	for {
+		item, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(item); err != nil {
+			return err
+		}
+	}
+}
+
+// PBArgs 模拟protoc生成的消息类型，字段1为a，字段2为b
+type PBArgs struct {
+	A, B int64
+}
+
+func (m *PBArgs) Marshal() ([]byte, error) {
+	b := binary.AppendUvarint(nil, 1<<3)
+	b = binary.AppendUvarint(b, uint64(m.A))
+	b = binary.AppendUvarint(b, 2<<3)
+	return binary.AppendUvarint(b, uint64(m.B)), nil
+}
+
+func (m *PBArgs) Unmarshal(data []byte) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		v, l := binary.Uvarint(data[n:])
+		if n <= 0 || l <= 0 {
+			return errors.New("bad PBArgs")
+		}
+		switch tag >> 3 {
+		case 1:
+			m.A = int64(v)
+		case 2:
+			m.B = int64(v)
+		}
+		data = data[n+l:]
+	}
+	return nil
+}
+
+// PBSum 模拟protoc生成的消息类型，字段1为sum
+type PBSum struct {
+	Sum int64
+}
+
+func (m *PBSum) Marshal() ([]byte, error) {
+	b := binary.AppendUvarint(nil, 1<<3)
+	return binary.AppendUvarint(b, uint64(m.Sum)), nil
+}
+
+func (m *PBSum) Unmarshal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	v, n := binary.Uvarint(data[1:])
+	if data[0] != 1<<3 || n <= 0 {
+		return errors.New("bad PBSum")
+	}
+	m.Sum = int64(v)
+	return nil
+}
+
+type PBAdder struct{}
+
+func (a *PBAdder) Add(args *PBArgs, reply *PBSum) error {
+	reply.Sum = args.A + args.B
+	return nil
+}
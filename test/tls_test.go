@@ -0,0 +1,114 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+)
+
+// 用CA签发一个证书，ca为nil时生成自签名的CA
+func issueCert(t *testing.T, cn string, ca *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	parent, signer := tmpl, any(key)
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := issueCert(t, "toyrpc-ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	svrCert := issueCert(t, "server", &ca)
+	cliCert := issueCert(t, "alice", &ca)
+
+	registry, svr, _, _ := startServer(t, toyrpc.WithSvrTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{svrCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+	}))
+	defer svr.Shutdown(context.Background())
+	if err := svr.AsService(&MetaService{}); err != nil {
+		t.Fatal(err)
+	}
+	waitRegistered(t, registry.URL, "MetaService", true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("client certificate", func(t *testing.T) {
+		cli := toyrpc.NewClient(registry.URL, toyrpc.WithTLSConfig(&tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{cliCert},
+		}))
+		defer cli.Close()
+		var identity string
+		if err := cli.Call(ctx, "MetaService", "Whoami", "", &identity); err != nil || identity != "alice" {
+			t.Fatalf("expect alice, got %q, err: %v", identity, err)
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		cli := toyrpc.NewClient(registry.URL, toyrpc.WithTLSConfig(&tls.Config{RootCAs: pool}))
+		defer cli.Close()
+		var identity string
+		if err := cli.Call(ctx, "MetaService", "Whoami", "", &identity); toyrpc.Code(err) != toyrpc.CodeUnauthenticated {
+			t.Fatalf("expect Unauthenticated, got %v", err)
+		}
+		var sum int
+		if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+			t.Fatalf("expect 3, got %d, err: %v", sum, err)
+		}
+	})
+
+	t.Run("untrusted server", func(t *testing.T) {
+		cli := toyrpc.NewClient(registry.URL, toyrpc.WithTLSConfig(&tls.Config{}))
+		defer cli.Close()
+		var sum int
+		if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err == nil {
+			t.Fatal("expect certificate verification error")
+		}
+	})
+
+	t.Run("plaintext client", func(t *testing.T) {
+		cli := toyrpc.NewClient(registry.URL)
+		defer cli.Close()
+		var sum int
+		if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err == nil {
+			t.Fatal("expect plaintext connection to fail")
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2evl1u/toyrpc"
+)
+
+func TestUnixSocket(t *testing.T) {
+	registry := httptest.NewServer(toyrpc.NewRegistry())
+	defer registry.Close()
+	path := filepath.Join(t.TempDir(), "toyrpc.sock")
+	svr := toyrpc.NewServer(registry.URL, toyrpc.WithSvrNetwork("unix"), toyrpc.WithSvrAddress(path))
+	if err := svr.AsService(&Adder{}); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- svr.Start()
+	}()
+	waitRegistered(t, registry.URL, "Adder", true)
+
+	// 注册中心保存带有网络类型的地址，不会补全IP
+	resp, err := http.Get(registry.URL + toyrpc.DefaultRegisterPath + "?serviceName=Adder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	_ = json.NewDecoder(resp.Body).Decode(&addrs)
+	_ = resp.Body.Close()
+	if len(addrs) != 1 || addrs[0] != "unix@"+path {
+		t.Fatalf("unexpected registered addresses: %v", addrs)
+	}
+
+	cli := toyrpc.NewClient(registry.URL)
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sum int
+	if err = cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("expect 3, got %d, err: %v", sum, err)
+	}
+
+	if err = svr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-served; !errors.Is(err, toyrpc.ErrServerClosed) {
+		t.Fatalf("expect ErrServerClosed, got %v", err)
+	}
+	waitRegistered(t, registry.URL, "Adder", false)
+}
+
+func TestPipe(t *testing.T) {
+	listener, err := toyrpc.ListenPipe("adder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = toyrpc.ListenPipe("adder"); err == nil {
+		t.Fatal("expect pipe name in use error")
+	}
+	// 不使用注册中心，客户端直接连接进程内的服务器
+	svr := toyrpc.NewServer("")
+	if err = svr.AsService(&Adder{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = svr.AsService(&Feed{}); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- svr.Serve(listener)
+	}()
+	cli := toyrpc.NewClient("", toyrpc.WithServerAddrs(toyrpc.PipeNetwork+"@adder"))
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sum int
+	if err = cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err != nil || sum != 3 {
+		t.Fatalf("expect 3, got %d, err: %v", sum, err)
+	}
+	r, err := toyrpc.CallStream[Item](ctx, cli, "Feed", "Count", Args{A: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for r.Next() {
+		n++
+	}
+	if err = r.Err(); err != nil || n != 50 {
+		t.Fatalf("expect 50 items, got %d, err: %v", n, err)
+	}
+
+	if err = svr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-served; !errors.Is(err, toyrpc.ErrServerClosed) {
+		t.Fatalf("expect ErrServerClosed, got %v", err)
+	}
+	if _, err = toyrpc.DialPipe("adder"); !errors.Is(err, toyrpc.ErrPipeNotFound) {
+		t.Fatalf("expect ErrPipeNotFound, got %v", err)
+	}
+}
+
+func TestRegistryUnreachable(t *testing.T) {
+	cli := toyrpc.NewClient("http://127.0.0.1:1")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sum int
+	if err := cli.Call(ctx, "Adder", "Add", Args{A: 1, B: 2}, &sum); err == nil || !strings.Contains(err.Error(), "no available servers") {
+		t.Fatalf("expect no available servers, got %v", err)
+	}
+}
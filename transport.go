@@ -0,0 +1,120 @@
+package toyrpc
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// PipeNetwork 进程内的网络类型，客户端与服务器通过net.Pipe直接相连，不使用任何socket
+const PipeNetwork = "pipe"
+
+// 服务实例的地址为"network@address"的形式时使用其中的网络类型，例如"unix@/tmp/toyrpc.sock"
+// tcp地址仍为"host:port"的形式，网络类型由选项决定
+func splitNetAddr(address, network string) (string, string) {
+	if n, addr, ok := strings.Cut(address, "@"); ok && n != "" {
+		return n, addr
+	}
+	return network, address
+}
+
+// 上报给注册中心的地址，tcp为":port"的形式，由注册中心补全IP，其他网络类型带上网络类型的前缀
+func advertiseAddr(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return ":" + strconv.Itoa(tcpAddr.Port)
+	}
+	return addr.Network() + "@" + addr.String()
+}
+
+func listen(network, address string) (net.Listener, error) {
+	if network == PipeNetwork {
+		return ListenPipe(address)
+	}
+	return net.Listen(network, address)
+}
+
+func dial(network, address string) (net.Conn, error) {
+	if network == PipeNetwork {
+		return DialPipe(address)
+	}
+	return net.Dial(network, address)
+}
+
+var (
+	ErrPipeClosed   = errors.New("pipe listener is closed")
+	ErrPipeNotFound = errors.New("pipe listener not found")
+)
+
+// 进程内所有正在监听的PipeListener，以名字区分
+var pipes sync.Map
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return PipeNetwork }
+func (a pipeAddr) String() string  { return string(a) }
+
+// PipeListener 进程内的listener，通过DialPipe建立的连接由Accept返回
+// 用于在单元测试中不经过任何socket直接连接客户端与服务器
+type PipeListener struct {
+	name      string
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenPipe 以name监听进程内的连接，同一时间一个name只能被一个PipeListener使用
+func ListenPipe(name string) (*PipeListener, error) {
+	l := &PipeListener{
+		name:  name,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	if _, loaded := pipes.LoadOrStore(name, l); loaded {
+		return nil, errors.Errorf("pipe %s is already in use", name)
+	}
+	return l, nil
+}
+
+// DialPipe 连接以name监听的PipeListener
+func DialPipe(name string) (net.Conn, error) {
+	v, ok := pipes.Load(name)
+	if !ok {
+		return nil, errors.WithMessage(ErrPipeNotFound, name)
+	}
+	return v.(*PipeListener).dial()
+}
+
+func (l *PipeListener) dial() (net.Conn, error) {
+	cliConn, svrConn := net.Pipe()
+	select {
+	case l.conns <- svrConn:
+		return cliConn, nil
+	case <-l.done:
+		return nil, ErrPipeClosed
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrPipeClosed
+	}
+}
+
+// Close 停止接受新的连接，已经建立的连接不受影响
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		pipes.CompareAndDelete(l.name, l)
+	})
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
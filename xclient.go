@@ -2,6 +2,7 @@ package toyrpc
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"math/rand"
@@ -22,8 +23,9 @@ const (
 )
 
 type Client struct {
-	d          *discovery
-	selectMode SelectMode
+	d            *discovery
+	selectMode   SelectMode
+	interceptors []CliInterceptor
 }
 
 type discovery struct {
@@ -32,6 +34,8 @@ type discovery struct {
 	updateInterval time.Duration
 	registry       string
 	r              *rand.Rand
+	cliOpts        []CliOption // 连接服务实例时新建client使用的选项
+	addrs          []string    // 直接指定的服务实例地址，不为空时不经过注册中心
 }
 
 type serviceClients struct {
@@ -47,13 +51,22 @@ type cliDetail struct {
 
 // 根据服务名，选择模式来选取一个可用的客户端实例
 func (d *discovery) get(serviceName string, mode SelectMode) (*client, error) {
+	d.mu.RLock()
 	svcClients, ok := d.svcMap[serviceName]
+	d.mu.RUnlock()
 	// 第一次调用，discovery还未存在对应服务
+	var updateErr error
 	if !ok {
-		if err := d.update(serviceName); err != nil {
-			ErrorLogger.Printf("Update discovery fail: %s\n", err)
+		if updateErr = d.update(serviceName); updateErr != nil {
+			ErrorLogger.Printf("Update discovery fail: %s\n", updateErr)
 		}
+		d.mu.RLock()
 		svcClients = d.svcMap[serviceName]
+		d.mu.RUnlock()
+		// 注册中心不可用时不会创建服务对应的客户端列表，按照没有可用的服务实例处理
+		if svcClients == nil {
+			svcClients = new(serviceClients)
+		}
 	}
 	// 不一开始就上锁的原因是 d.update中会上锁，go的锁不可重入
 	d.mu.Lock()
@@ -62,6 +75,9 @@ func (d *discovery) get(serviceName string, mode SelectMode) (*client, error) {
 	for {
 		n := len(svcClients.list)
 		if n == 0 {
+			if updateErr != nil {
+				return nil, errors.WithMessage(updateErr, "no available servers")
+			}
 			return nil, errors.New("no available servers")
 		}
 		switch mode {
@@ -85,10 +101,16 @@ func (d *discovery) get(serviceName string, mode SelectMode) (*client, error) {
 
 // 从注册中心拉取服务实例地址
 func (d *discovery) fetch(serviceName string) ([]string, error) {
+	// 直接指定了服务实例时不经过注册中心
+	if len(d.addrs) > 0 {
+		return d.addrs, nil
+	}
 	resp, err := http.Get(d.registry + DefaultRegisterPath + "?serviceName=" + serviceName)
 	if err != nil {
 		ErrorLogger.Println("dicovery fetch service addr fail:", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 	bs, err := io.ReadAll(resp.Body)
 	if err != nil {
 		ErrorLogger.Println("read body fail:", err)
@@ -109,6 +131,7 @@ func (d *discovery) update(serviceName string) error {
 		return err
 	}
 	CommonLogger.Printf("Successfully fetching services: %s\n", svcAddrs)
+	var connErr error
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	if _, ok := d.svcMap[serviceName]; !ok {
@@ -116,9 +139,15 @@ func (d *discovery) update(serviceName string) error {
 		d.svcMap[serviceName] = new(serviceClients)
 		// 全加入到list中
 		for _, addr := range svcAddrs {
+			cli, err := newClient(addr, d.cliOpts...)
+			if err != nil {
+				ErrorLogger.Printf("Connect to %s fail: %s\n", addr, err)
+				connErr = err
+				continue
+			}
 			d.svcMap[serviceName].list = append(d.svcMap[serviceName].list, cliDetail{
 				addr:        addr,
-				cli:         newClient(addr),
+				cli:         cli,
 				lastUpdated: time.Now(),
 			})
 		}
@@ -133,14 +162,24 @@ func (d *discovery) update(serviceName string) error {
 				}
 			}
 			if !existed {
+				cli, err := newClient(addr, d.cliOpts...)
+				if err != nil {
+					ErrorLogger.Printf("Connect to %s fail: %s\n", addr, err)
+					connErr = err
+					continue
+				}
 				d.svcMap[serviceName].list = append(d.svcMap[serviceName].list, cliDetail{
 					addr:        addr,
-					cli:         newClient(addr),
+					cli:         cli,
 					lastUpdated: time.Now(),
 				})
 			}
 		}
 	}
+	// 没有任何可用的服务实例时，将连接失败的原因返回给调用方
+	if connErr != nil && len(d.svcMap[serviceName].list) == 0 {
+		return errors.WithMessage(connErr, "no server can be connected")
+	}
 	CommonLogger.Println("Update discovery services successfully")
 	return nil
 }
@@ -162,6 +201,36 @@ func WithSelectMode(selectMode SelectMode) CliOpt {
 	}
 }
 
+// WithCodecType 设置连接服务实例时优先使用的编码类型，服务端不支持时会退回内置的编码类型
+func WithCodecType(codecType string) CliOpt {
+	return func(c *Client) {
+		c.d.cliOpts = append(c.d.cliOpts, WithCliCodecType(codecType))
+	}
+}
+
+// WithTLSConfig 使用TLS连接服务实例
+func WithTLSConfig(config *tls.Config) CliOpt {
+	return func(c *Client) {
+		c.d.cliOpts = append(c.d.cliOpts, WithCliTLSConfig(config))
+	}
+}
+
+// WithCompression 要求启用压缩，compressor为压缩方式的名字，例如codec.GzipCompressor
+// threshold只作用于客户端发送的请求，服务端按照自己的WithSvrCompressThreshold压缩返回
+func WithCompression(compressor string, threshold int) CliOpt {
+	return func(c *Client) {
+		c.d.cliOpts = append(c.d.cliOpts, WithCliCompression(compressor, threshold))
+	}
+}
+
+// WithServerAddrs 不经过注册中心，直接连接给定的服务实例，所有服务都从这些实例中选取
+// 地址可以为"host:port"，也可以带上网络类型，例如"unix@/tmp/toyrpc.sock"、"pipe@name"
+func WithServerAddrs(addrs ...string) CliOpt {
+	return func(c *Client) {
+		c.d.addrs = addrs
+	}
+}
+
 // WithUpdateInterval 用来设置客户端存储的服务实例的过期时间
 func WithUpdateInterval(interval time.Duration) CliOpt {
 	return func(c *Client) {
@@ -169,6 +238,7 @@ func WithUpdateInterval(interval time.Duration) CliOpt {
 	}
 }
 
+// NewClient 从注册中心获取服务实例，使用WithServerAddrs直接指定服务实例时registry可以为空
 func NewClient(registry string, opts ...CliOpt) *Client {
 	cli := &Client{
 		d: &discovery{
@@ -197,11 +267,55 @@ func NewClient(registry string, opts ...CliOpt) *Client {
 }
 
 func (cli *Client) Call(ctx context.Context, serviceName, methodName string, args, reply any) error {
-	c, err := cli.d.get(serviceName, cli.selectMode)
-	if err != nil {
-		return err
+	info := &CallInfo{Service: serviceName, Method: methodName}
+	// 服务实例的选取也在拦截器之内，发现与选取的失败同样经过拦截器
+	invoker := chainCliInterceptors(cli.interceptors, info, func(ctx context.Context, args, reply any) error {
+		c, err := cli.d.get(serviceName, cli.selectMode)
+		if err != nil {
+			return err
+		}
+		info.Addr = c.targetAddr
+		return c.call(ctx, serviceName, methodName, args, reply)
+	})
+	return invoker(ctx, args, reply)
+}
+
+// Notify 单向调用，请求发出后立即返回，服务端执行方法之后不发送返回
+// 返回的错误只表示请求是否发送成功，服务方法的错误以及返回值都会被丢弃
+func (cli *Client) Notify(ctx context.Context, serviceName, methodName string, args any) error {
+	info := &CallInfo{Service: serviceName, Method: methodName, OneWay: true}
+	invoker := chainCliInterceptors(cli.interceptors, info, func(ctx context.Context, args, _ any) error {
+		c, err := cli.d.get(serviceName, cli.selectMode)
+		if err != nil {
+			return err
+		}
+		info.Addr = c.targetAddr
+		return c.notify(ctx, serviceName, methodName, args)
+	})
+	return invoker(ctx, args, nil)
+}
+
+// Go 异步调用，立即返回代表这次调用的Call，调用结束时Call会被发送到done中
+// done为nil时会新建一个带缓冲的channel，否则done必须带有缓冲
+// 可以在一个goroutine中发起多个调用，再从同一个done中依次取回结果
+func (cli *Client) Go(ctx context.Context, serviceName, methodName string, args, reply any, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		ErrorLogger.Panic("done channel is unbuffered")
+	}
+	call := &Call{
+		Service: serviceName,
+		Method:  methodName,
+		Args:    args,
+		Reply:   reply,
+		Done:    done,
 	}
-	return c.call(ctx, serviceName, methodName, args, reply)
+	go func() {
+		call.Error = cli.Call(ctx, serviceName, methodName, args, reply)
+		call.done()
+	}()
+	return call
 }
 
 func (cli *Client) Close() error {